@@ -1,17 +1,28 @@
 package communication
 
 import (
+	"context"
 	commonCommunication "github.com/kulycloud/common/communication"
+	protoCommon "github.com/kulycloud/protocol/common"
 	protoServices "github.com/kulycloud/protocol/services"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var ControlPlane *commonCommunication.ControlPlaneCommunicator
 
 var _ protoServices.ServiceManagerServer = &ServiceManagerHandler{}
 
+// OnDemandReconciler runs reconciles requested by other components and reports their outcome
+type OnDemandReconciler interface {
+	ReconcileNamespaceNow(ctx context.Context, namespace string) error
+	ReconcileAll(ctx context.Context) error
+}
+
 type ServiceManagerHandler struct {
 	protoServices.UnimplementedServiceManagerServer
-	listener *commonCommunication.Listener
+	listener   *commonCommunication.Listener
+	reconciler OnDemandReconciler
 }
 
 func NewServiceManagerHandler(listener *commonCommunication.Listener) *ServiceManagerHandler {
@@ -23,3 +34,27 @@ func NewServiceManagerHandler(listener *commonCommunication.Listener) *ServiceMa
 func (handler *ServiceManagerHandler) Register() {
 	protoServices.RegisterServiceManagerServer(handler.listener.Server, handler)
 }
+
+// SetReconciler enables the reconcile RPCs. The reconciler can only be created after the handler is serving.
+func (handler *ServiceManagerHandler) SetReconciler(reconciler OnDemandReconciler) {
+	handler.reconciler = reconciler
+}
+
+// Reconcile reconciles the requested namespace or every namespace if none is set
+func (handler *ServiceManagerHandler) Reconcile(ctx context.Context, request *protoServices.ReconcileRequest) (*protoCommon.Empty, error) {
+	if handler.reconciler == nil {
+		return nil, status.Error(codes.Unavailable, "reconciler is not ready yet")
+	}
+
+	var err error
+	if request.Namespace == "" {
+		err = handler.reconciler.ReconcileAll(ctx)
+	} else {
+		err = handler.reconciler.ReconcileNamespaceNow(ctx, request.Namespace)
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "reconcile failed: %s", err)
+	}
+	return &protoCommon.Empty{}, nil
+}
@@ -1,27 +1,297 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	commonConfig "github.com/kulycloud/common/config"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	NamespaceModeShared   = "shared"
+	NamespaceModeSeparate = "separate"
+
+	DriftPolicyRevert = "revert"
+	DriftPolicyReport = "report"
+	DriftPolicyIgnore = "ignore"
+)
+
+// Params tagged with hotReload are applied while running when the config file changes.
+// "render" marks params that change the rendered resources, "safe" params that do not.
 type Config struct {
-	Host                    string `configName:"host"`
-	Port                    uint32 `configName:"port"`
-	ControlPlaneHost        string `configName:"controlPlaneHost"`
-	ControlPlanePort        uint32 `configName:"controlPlanePort"`
-	Kubeconfig              string `configName:"kubeconfig" defaultValue:""`
-	ServiceNamespace        string `configName:"serviceNamespace" defaultValue:"kuly-services"`
-	LoadBalancerImage       string `configName:"loadBalancerImage" defaultValue:"kuly/loadbalancer"`
-	LoadBalancerControlPort uint32 `configName:"loadBalancerControlPort" defaultValue:"12270"`
-	HTTPPort                uint32 `configName:"httpPort" defaultValue:"30000"`
+	Host                    string  `configName:"host"`
+	Port                    uint32  `configName:"port"`
+	ControlPlaneHost        string  `configName:"controlPlaneHost"`
+	ControlPlanePort        uint32  `configName:"controlPlanePort"`
+	ConfigFile              string  `configName:"configFile" defaultValue:""`
+	Kubeconfig              string  `configName:"kubeconfig" defaultValue:""`
+	Clusters                string  `configName:"clusters" defaultValue:""`
+	ServiceNamespace        string  `configName:"serviceNamespace" defaultValue:"kuly-services"`
+	NamespaceMode           string  `configName:"namespaceMode" defaultValue:"shared"`
+	NamespaceNameTemplate   string  `configName:"namespaceNameTemplate" defaultValue:"kuly-{namespace}"`
+	LoadBalancerImage       string  `configName:"loadBalancerImage" defaultValue:"kuly/loadbalancer" hotReload:"render"`
+	LoadBalancerControlPort uint32  `configName:"loadBalancerControlPort" defaultValue:"12270"`
+	HTTPPort                uint32  `configName:"httpPort" defaultValue:"30000" hotReload:"render"`
+	PolicyFile              string  `configName:"policyFile" defaultValue:""`
+	RevisionHistoryLimit    uint32  `configName:"revisionHistoryLimit" defaultValue:"10" hotReload:"safe"`
+	ReconcilePeriod         string  `configName:"reconcilePeriod" defaultValue:"1h" hotReload:"safe"`
+	ReconcileCheckLoop      string  `configName:"reconcileCheckLoop" defaultValue:"5m" hotReload:"safe"`
+	ReconcileErrorRetry     string  `configName:"reconcileErrorRetry" defaultValue:"1m" hotReload:"safe"`
+	ReconcileMaxBackoff     string  `configName:"reconcileMaxBackoff" defaultValue:"30m" hotReload:"safe"`
+	ReconcileJitter         float64 `configName:"reconcileJitter" defaultValue:"0.1" hotReload:"safe"`
+	StorageWaitInterval     string  `configName:"storageWaitInterval" defaultValue:"10s" hotReload:"safe"`
+	DeletionGuardServices   uint32  `configName:"deletionGuardServices" defaultValue:"10" hotReload:"safe"`
+	DeletionGuardPercent    uint32  `configName:"deletionGuardPercent" defaultValue:"50" hotReload:"safe"`
+	DriftPolicy             string  `configName:"driftPolicy" defaultValue:"revert" hotReload:"safe"`
+}
+
+// Timing are the parsed durations of the reconcile loop
+type Timing struct {
+	ReconcilePeriod     time.Duration
+	ReconcileCheckLoop  time.Duration
+	ReconcileErrorRetry time.Duration
+	ReconcileMaxBackoff time.Duration
+	ReconcileJitter     float64
+	StorageWaitInterval time.Duration
+}
+
+// global holds the running config and policies. The config loop replaces them while the rest of the manager
+// reads them, so they are only accessed through GlobalConfig, GlobalPolicies and SetGlobal.
+var global atomic.Value
+
+type globalState struct {
+	config   *Config
+	policies *Policies
+}
+
+func init() {
+	SetGlobal(&Config{}, &Policies{})
+}
+
+// GlobalConfig returns the running config. It must not be changed, a new config is set with SetGlobal.
+func GlobalConfig() *Config {
+	return global.Load().(*globalState).config
+}
+
+// GlobalPolicies returns the running policies. They must not be changed, new policies are set with SetGlobal.
+func GlobalPolicies() *Policies {
+	return global.Load().(*globalState).policies
 }
 
-var GlobalConfig = &Config{}
+// SetGlobal replaces the running config and policies at once
+func SetGlobal(config *Config, policies *Policies) {
+	global.Store(&globalState{config: config, policies: policies})
+}
 
 func ParseConfig() error {
+	parsed, policies, err := parse()
+	if err != nil {
+		return err
+	}
+
+	SetGlobal(parsed, policies)
+	return nil
+}
+
+// offlineParams fill in the params that are only needed to connect to the control plane
+var offlineParams = staticProvider{
+	"host":             "localhost",
+	"port":             "12270",
+	"controlPlaneHost": "localhost",
+	"controlPlanePort": "12270",
+}
+
+// ParseOfflineConfig parses the config for commands that do not connect to the control plane
+func ParseOfflineConfig() error {
+	parsed, policies, err := parse(offlineParams)
+	if err != nil {
+		return err
+	}
+
+	SetGlobal(parsed, policies)
+	return nil
+}
+
+type staticProvider map[string]string
+
+func (provider staticProvider) Get(name string) (string, error) {
+	value, ok := provider[name]
+	if !ok {
+		return "", commonConfig.ErrParamNotFound
+	}
+	return value, nil
+}
+
+// parse reads the config from cli params, environment variables, the config file and the fallback providers
+// in that order of precedence
+func parse(fallbacks ...commonConfig.Provider) (*Config, *Policies, error) {
 	parser := commonConfig.NewParser()
 	parser.AddProvider(commonConfig.NewCliParamProvider())
 	parser.AddProvider(commonConfig.NewEnvironmentVariableProvider())
 
-	return parser.Populate(GlobalConfig)
+	var file *FileProvider
+	configFile, err := parser.GetParam("configFile")
+	if err == nil {
+		file, err = NewFileProvider(configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		parser.AddProvider(file)
+	} else if !errors.Is(err, commonConfig.ErrParamNotFound) {
+		return nil, nil, err
+	}
+	for _, provider := range fallbacks {
+		parser.AddProvider(provider)
+	}
+
+	parsed := &Config{}
+	err = parser.Populate(parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = parsed.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policies := &Policies{}
+	if file != nil && file.Policies != nil {
+		policies = file.Policies
+	}
+	if parsed.PolicyFile != "" {
+		if file != nil && file.Policies != nil {
+			return nil, nil, errors.New("policies are set in both the config file and the policy file")
+		}
+		policies, err = LoadPolicies(parsed.PolicyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = policies.checkClusters(parsed.ClusterNames())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parsed, policies, nil
+}
+
+// Validate checks all params and reports every invalid one at once
+func (config *Config) Validate() error {
+	problems := make([]string, 0)
+	invalid := func(name string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	for name, port := range map[string]uint32{
+		"port":                    config.Port,
+		"controlPlanePort":        config.ControlPlanePort,
+		"loadBalancerControlPort": config.LoadBalancerControlPort,
+		"httpPort":                config.HTTPPort,
+	} {
+		if port == 0 || port > 65535 {
+			invalid(name, "port %d is not between 1 and 65535", port)
+		}
+	}
+	if config.LoadBalancerControlPort == config.HTTPPort {
+		invalid("httpPort", "must differ from loadBalancerControlPort")
+	}
+
+	if config.Host == "" {
+		invalid("host", "must not be empty")
+	}
+	if config.ControlPlaneHost == "" {
+		invalid("controlPlaneHost", "must not be empty")
+	}
+	if config.LoadBalancerImage == "" {
+		invalid("loadBalancerImage", "must not be empty")
+	}
+	if config.RevisionHistoryLimit == 0 {
+		invalid("revisionHistoryLimit", "must keep at least one revision")
+	}
+
+	durations := map[string]string{
+		"reconcilePeriod":     config.ReconcilePeriod,
+		"reconcileCheckLoop":  config.ReconcileCheckLoop,
+		"reconcileErrorRetry": config.ReconcileErrorRetry,
+		"reconcileMaxBackoff": config.ReconcileMaxBackoff,
+		"storageWaitInterval": config.StorageWaitInterval,
+	}
+	for name, value := range durations {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			invalid(name, "%q is not a duration", value)
+		} else if duration <= 0 {
+			invalid(name, "must be positive")
+		}
+	}
+	if config.DeletionGuardPercent > 100 {
+		invalid("deletionGuardPercent", "%d is not between 0 and 100", config.DeletionGuardPercent)
+	}
+	if config.ReconcileJitter < 0 || config.ReconcileJitter >= 1 {
+		invalid("reconcileJitter", "%v is not between 0 and 1", config.ReconcileJitter)
+	}
+
+	switch config.DriftPolicy {
+	case DriftPolicyRevert, DriftPolicyReport, DriftPolicyIgnore:
+	default:
+		invalid("driftPolicy", "%q is not one of %q, %q and %q", config.DriftPolicy, DriftPolicyRevert, DriftPolicyReport, DriftPolicyIgnore)
+	}
+
+	switch config.NamespaceMode {
+	case NamespaceModeShared:
+		for _, msg := range validation.IsDNS1123Label(config.ServiceNamespace) {
+			invalid("serviceNamespace", msg)
+		}
+	case NamespaceModeSeparate:
+		if !strings.Contains(config.NamespaceNameTemplate, "{namespace}") {
+			invalid("namespaceNameTemplate", "must contain {namespace}")
+		}
+		// the template itself has to produce valid names, the kuly namespace is checked when it is created
+		for _, msg := range validation.IsDNS1123Label(strings.ReplaceAll(config.NamespaceNameTemplate, "{namespace}", "a")) {
+			invalid("namespaceNameTemplate", msg)
+		}
+	default:
+		invalid("namespaceMode", "%q is neither %q nor %q", config.NamespaceMode, NamespaceModeShared, NamespaceModeSeparate)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ClusterNames returns the kubeconfig contexts of the clusters to manage. Without any the manager runs in a single cluster.
+// Load balancer endpoints are shared between the clusters as pod IPs, so multiple clusters need a flat pod network.
+func (config *Config) ClusterNames() []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(config.Clusters, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Timing parses the durations of the reconcile loop. They are known to be valid after the config has been validated.
+func (config *Config) Timing() Timing {
+	duration := func(value string) time.Duration {
+		parsed, _ := time.ParseDuration(value)
+		return parsed
+	}
+
+	return Timing{
+		ReconcilePeriod:     duration(config.ReconcilePeriod),
+		ReconcileCheckLoop:  duration(config.ReconcileCheckLoop),
+		ReconcileErrorRetry: duration(config.ReconcileErrorRetry),
+		ReconcileMaxBackoff: duration(config.ReconcileMaxBackoff),
+		ReconcileJitter:     config.ReconcileJitter,
+		StorageWaitInterval: duration(config.StorageWaitInterval),
+	}
 }
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func validConfig() *Config {
+	return &Config{
+		Host:                    "localhost",
+		Port:                    12270,
+		ControlPlaneHost:        "localhost",
+		ControlPlanePort:        12270,
+		ServiceNamespace:        "kuly-services",
+		NamespaceMode:           NamespaceModeShared,
+		NamespaceNameTemplate:   "kuly-{namespace}",
+		LoadBalancerImage:       "kuly/loadbalancer",
+		LoadBalancerControlPort: 12270,
+		HTTPPort:                30000,
+		RevisionHistoryLimit:    10,
+		ReconcilePeriod:         "1h",
+		ReconcileCheckLoop:      "5m",
+		ReconcileErrorRetry:     "1m",
+		ReconcileMaxBackoff:     "30m",
+		ReconcileJitter:         0.1,
+		StorageWaitInterval:     "10s",
+		DeletionGuardServices:   10,
+		DeletionGuardPercent:    50,
+		DriftPolicy:             DriftPolicyRevert,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(config *Config)
+		problems []string
+	}{
+		{
+			name:   "valid",
+			change: func(config *Config) {},
+		},
+		{
+			name:     "port out of range",
+			change:   func(config *Config) { config.Port = 70000 },
+			problems: []string{"port: port 70000 is not between 1 and 65535"},
+		},
+		{
+			name:     "same ports",
+			change:   func(config *Config) { config.HTTPPort = config.LoadBalancerControlPort },
+			problems: []string{"httpPort: must differ from loadBalancerControlPort"},
+		},
+		{
+			name:     "invalid duration",
+			change:   func(config *Config) { config.ReconcilePeriod = "hourly" },
+			problems: []string{`reconcilePeriod: "hourly" is not a duration`},
+		},
+		{
+			name:     "negative duration",
+			change:   func(config *Config) { config.ReconcileErrorRetry = "-1m" },
+			problems: []string{"reconcileErrorRetry: must be positive"},
+		},
+		{
+			name:     "unknown drift policy",
+			change:   func(config *Config) { config.DriftPolicy = "keep" },
+			problems: []string{`driftPolicy: "keep" is not one of`},
+		},
+		{
+			name: "namespace template without namespace",
+			change: func(config *Config) {
+				config.NamespaceMode = NamespaceModeSeparate
+				config.NamespaceNameTemplate = "kuly"
+			},
+			problems: []string{"namespaceNameTemplate: must contain {namespace}"},
+		},
+		{
+			name: "invalid namespace template",
+			change: func(config *Config) {
+				config.NamespaceMode = NamespaceModeSeparate
+				config.NamespaceNameTemplate = "Kuly_{namespace}"
+			},
+			problems: []string{"namespaceNameTemplate: a DNS-1123 label must consist of"},
+		},
+		{
+			name: "every problem is reported",
+			change: func(config *Config) {
+				config.Host = ""
+				config.LoadBalancerImage = ""
+				config.RevisionHistoryLimit = 0
+				config.DeletionGuardPercent = 101
+				config.ReconcileJitter = 1
+				config.NamespaceMode = "mixed"
+			},
+			problems: []string{
+				"host: must not be empty",
+				"loadBalancerImage: must not be empty",
+				"revisionHistoryLimit: must keep at least one revision",
+				"deletionGuardPercent: 101 is not between 0 and 100",
+				"reconcileJitter: 1 is not between 0 and 1",
+				`namespaceMode: "mixed" is neither`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validConfig()
+			test.change(config)
+			err := config.Validate()
+
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Fatalf("expected the config to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected the config to be invalid")
+			}
+			reported := strings.Count(err.Error(), "\n")
+			if reported != len(test.problems) {
+				t.Errorf("expected %d problems, got %d: %v", len(test.problems), reported, err)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("expected problem %q, got %v", problem, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	commonConfig "github.com/kulycloud/common/config"
+	"io/ioutil"
+	"reflect"
+	"sigs.k8s.io/yaml"
+)
+
+const policiesKey = "policies"
+
+var _ commonConfig.Provider = &FileProvider{}
+
+// FileProvider reads params from a YAML file. Params use their configName as key,
+// structured policies can be set under the policies key instead of a separate policy file.
+type FileProvider struct {
+	params   map[string]string
+	Policies *Policies
+}
+
+func NewFileProvider(path string) (*FileProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	return parseConfigFile(data)
+}
+
+func parseConfigFile(data []byte) (*FileProvider, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file: %w", err)
+	}
+
+	values := make(map[string]json.RawMessage)
+	err = json.Unmarshal(jsonData, &values)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file: %w", err)
+	}
+
+	provider := &FileProvider{params: make(map[string]string)}
+	known := configNames()
+	for name, raw := range values {
+		if name == policiesKey {
+			provider.Policies = &Policies{}
+			err = yaml.UnmarshalStrict(raw, provider.Policies)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse policies in config file: %w", err)
+			}
+			err = provider.Policies.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("policies in config file: %w", err)
+			}
+			continue
+		}
+
+		if !known[name] {
+			return nil, fmt.Errorf("unknown param %s in config file", name)
+		}
+
+		// Numbers are kept as written so large values are not turned into floats
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		var value interface{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse param %s in config file: %w", name, err)
+		}
+
+		switch value.(type) {
+		case string, json.Number, bool:
+			provider.params[name] = fmt.Sprint(value)
+		case nil:
+			// treated as not set
+		default:
+			return nil, fmt.Errorf("param %s in config file must be a string, number or boolean", name)
+		}
+	}
+
+	return provider, nil
+}
+
+func (provider *FileProvider) Get(name string) (string, error) {
+	value, ok := provider.params[name]
+	if !ok {
+		return "", commonConfig.ErrParamNotFound
+	}
+	return value, nil
+}
+
+func configNames() map[string]bool {
+	names := make(map[string]bool)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		if name, ok := configType.Field(i).Tag.Lookup("configName"); ok {
+			names[name] = true
+		}
+	}
+	return names
+}
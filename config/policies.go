@@ -0,0 +1,546 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+	"time"
+)
+
+// Quota limits what a single kuly namespace may request. MaxReplicas and the shared namespace limits only count
+// service replicas, load balancers are not included.
+type Quota struct {
+	MaxServices   int32  `json:"maxServices,omitempty"`
+	MaxReplicas   int32  `json:"maxReplicas,omitempty"`
+	CPU           string `json:"cpu,omitempty"`
+	Memory        string `json:"memory,omitempty"`
+	DefaultCPU    string `json:"defaultCpu,omitempty"`
+	DefaultMemory string `json:"defaultMemory,omitempty"`
+}
+
+// LoadBalancerPolicy configures the load balancer deployment of a service
+type LoadBalancerPolicy struct {
+	Replicas    *int32                       `json:"replicas,omitempty"`
+	Image       string                       `json:"image,omitempty"`
+	Resources   *corev1.ResourceRequirements `json:"resources,omitempty"`
+	Environment map[string]string            `json:"environment,omitempty"`
+	Autoscale   *LoadBalancerAutoscale       `json:"autoscale,omitempty"`
+}
+
+// LoadBalancerAutoscale scales the load balancer with the replica count of the service. It takes precedence over Replicas.
+type LoadBalancerAutoscale struct {
+	ServiceReplicasPerLoadBalancer int32 `json:"serviceReplicasPerLoadBalancer"`
+	MinReplicas                    int32 `json:"minReplicas,omitempty"`
+	MaxReplicas                    int32 `json:"maxReplicas,omitempty"`
+}
+
+const (
+	RolloutStrategyRollingUpdate = "rollingUpdate"
+	RolloutStrategyCanary        = "canary"
+	RolloutStrategyBlueGreen     = "blueGreen"
+)
+
+// RolloutPolicy configures how a new revision of a service is rolled out
+type RolloutPolicy struct {
+	Strategy         string           `json:"strategy,omitempty"`
+	Canary           *CanaryPolicy    `json:"canary,omitempty"`
+	BlueGreen        *BlueGreenPolicy `json:"blueGreen,omitempty"`
+	ProgressDeadline metav1.Duration  `json:"progressDeadline,omitempty"`
+	AutoRollback     bool             `json:"autoRollback,omitempty"`
+}
+
+const defaultProgressDeadline = 10 * time.Minute
+
+// CanaryPolicy configures the traffic steps of a canary rollout. Steps are the percentage of traffic sent to the canary.
+type CanaryPolicy struct {
+	Replicas     int32           `json:"replicas,omitempty"`
+	Steps        []int32         `json:"steps,omitempty"`
+	StepInterval metav1.Duration `json:"stepInterval,omitempty"`
+	MaxRestarts  int32           `json:"maxRestarts,omitempty"`
+}
+
+// BlueGreenPolicy configures how long the previous revision is kept after traffic has been switched to the new one
+type BlueGreenPolicy struct {
+	GracePeriod metav1.Duration `json:"gracePeriod,omitempty"`
+}
+
+var defaultBlueGreenPolicy = BlueGreenPolicy{
+	GracePeriod: metav1.Duration{Duration: 5 * time.Minute},
+}
+
+var defaultCanaryPolicy = CanaryPolicy{
+	Replicas:     1,
+	Steps:        []int32{10, 25, 50},
+	StepInterval: metav1.Duration{Duration: 5 * time.Minute},
+	MaxRestarts:  0,
+}
+
+// Overlay patches the rendered deployment of a service. Exactly one kind of patch is set.
+type Overlay struct {
+	StrategicMerge json.RawMessage `json:"strategicMerge,omitempty"`
+	JSONPatch      json.RawMessage `json:"jsonPatch,omitempty"`
+}
+
+const (
+	PlacementSingle = "single"
+	PlacementAll    = "all"
+	PlacementSpread = "spread"
+)
+
+// PlacementPolicy decides which clusters run a service. Spread divides the replicas among the clusters.
+type PlacementPolicy struct {
+	Mode string `json:"mode,omitempty"`
+	// Clusters restricts the placement to these clusters. Single placement uses the first one.
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+type ServicePolicy struct {
+	LoadBalancer *LoadBalancerPolicy `json:"loadBalancer,omitempty"`
+	Rollout      *RolloutPolicy      `json:"rollout,omitempty"`
+	Overlays     []Overlay           `json:"overlays,omitempty"`
+	Placement    *PlacementPolicy    `json:"placement,omitempty"`
+}
+
+type NamespacePolicy struct {
+	// ReconcilePeriod overrides how often the namespace is reconciled without a change event
+	ReconcilePeriod metav1.Duration     `json:"reconcilePeriod,omitempty"`
+	Quota           *Quota              `json:"quota,omitempty"`
+	LoadBalancer    *LoadBalancerPolicy `json:"loadBalancer,omitempty"`
+	Rollout         *RolloutPolicy      `json:"rollout,omitempty"`
+	Overlays        []Overlay           `json:"overlays,omitempty"`
+	Placement       *PlacementPolicy    `json:"placement,omitempty"`
+	// AllowMassDeletion turns off the deletion guard, e.g. for short lived namespaces
+	AllowMassDeletion bool                     `json:"allowMassDeletion,omitempty"`
+	Services          map[string]ServicePolicy `json:"services,omitempty"`
+}
+
+// Policies are structured per namespace settings that cannot be expressed as flat config values
+type Policies struct {
+	Defaults   NamespacePolicy            `json:"defaults"`
+	Namespaces map[string]NamespacePolicy `json:"namespaces"`
+}
+
+func LoadPolicies(path string) (*Policies, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read policy file: %w", err)
+	}
+
+	policies := &Policies{}
+	err = yaml.UnmarshalStrict(data, policies)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse policy file: %w", err)
+	}
+
+	err = policies.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (policies *Policies) Validate() error {
+	err := policies.Defaults.validate()
+	if err != nil {
+		return fmt.Errorf("defaults: %w", err)
+	}
+
+	for name, policy := range policies.Namespaces {
+		err = policy.validate()
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Namespace returns the effective policy of a namespace with unset parts taken from the defaults
+func (policies *Policies) Namespace(namespace string) NamespacePolicy {
+	policy := policies.Defaults
+	override, ok := policies.Namespaces[namespace]
+	if !ok {
+		return policy
+	}
+
+	if override.ReconcilePeriod.Duration != 0 {
+		policy.ReconcilePeriod = override.ReconcilePeriod
+	}
+	if override.Quota != nil {
+		policy.Quota = override.Quota
+	}
+	if override.Rollout != nil {
+		policy.Rollout = override.Rollout
+	}
+	if override.Placement != nil {
+		policy.Placement = override.Placement
+	}
+	if override.AllowMassDeletion {
+		policy.AllowMassDeletion = true
+	}
+	policy.LoadBalancer = policy.LoadBalancer.merge(override.LoadBalancer)
+	// overlays add up, namespace overlays are applied after the default ones
+	policy.Overlays = append(append([]Overlay{}, policy.Overlays...), override.Overlays...)
+	// service policies of the same service are merged like namespace policies
+	services := make(map[string]ServicePolicy, len(policy.Services)+len(override.Services))
+	for name, service := range policy.Services {
+		services[name] = service
+	}
+	for name, service := range override.Services {
+		services[name] = services[name].merge(service)
+	}
+	policy.Services = services
+	return policy
+}
+
+// merge returns the service policy with all fields set in override replaced, overlays add up
+func (policy ServicePolicy) merge(override ServicePolicy) ServicePolicy {
+	if override.Rollout != nil {
+		policy.Rollout = override.Rollout
+	}
+	if override.Placement != nil {
+		policy.Placement = override.Placement
+	}
+	policy.LoadBalancer = policy.LoadBalancer.merge(override.LoadBalancer)
+	policy.Overlays = append(append([]Overlay{}, policy.Overlays...), override.Overlays...)
+	return policy
+}
+
+// Overlays returns the overlays of a service in the order they are applied: defaults, namespace, service
+func (policies *Policies) Overlays(namespace string, service string) []Overlay {
+	policy := policies.Namespace(namespace)
+	return append(append([]Overlay{}, policy.Overlays...), policy.Services[service].Overlays...)
+}
+
+// Rollout returns the effective rollout policy of a service with strategy defaults filled in
+func (policies *Policies) Rollout(namespace string, service string) RolloutPolicy {
+	policy := policies.Namespace(namespace)
+	rollout := RolloutPolicy{Strategy: RolloutStrategyRollingUpdate}
+	if policy.Rollout != nil {
+		rollout = *policy.Rollout
+	}
+	if override := policy.Services[service].Rollout; override != nil {
+		rollout = *override
+	}
+
+	canary := defaultCanaryPolicy
+	if rollout.Canary != nil {
+		if rollout.Canary.Replicas > 0 {
+			canary.Replicas = rollout.Canary.Replicas
+		}
+		if len(rollout.Canary.Steps) > 0 {
+			canary.Steps = rollout.Canary.Steps
+		}
+		if rollout.Canary.StepInterval.Duration > 0 {
+			canary.StepInterval = rollout.Canary.StepInterval
+		}
+		canary.MaxRestarts = rollout.Canary.MaxRestarts
+	}
+	rollout.Canary = &canary
+
+	blueGreen := defaultBlueGreenPolicy
+	if rollout.BlueGreen != nil && rollout.BlueGreen.GracePeriod.Duration > 0 {
+		blueGreen.GracePeriod = rollout.BlueGreen.GracePeriod
+	}
+	rollout.BlueGreen = &blueGreen
+
+	if rollout.ProgressDeadline.Duration <= 0 {
+		rollout.ProgressDeadline.Duration = defaultProgressDeadline
+	}
+	return rollout
+}
+
+// LoadBalancer returns the effective load balancer policy of a service
+func (policies *Policies) LoadBalancer(namespace string, service string) LoadBalancerPolicy {
+	policy := policies.Namespace(namespace)
+	merged := policy.LoadBalancer.merge(policy.Services[service].LoadBalancer)
+	if merged == nil {
+		return LoadBalancerPolicy{}
+	}
+	return *merged
+}
+
+// Placement returns the effective placement of a service. Services are placed in a single cluster by default.
+func (policies *Policies) Placement(namespace string, service string) PlacementPolicy {
+	policy := policies.Namespace(namespace)
+	placement := PlacementPolicy{Mode: PlacementSingle}
+	if policy.Placement != nil {
+		placement = *policy.Placement
+	}
+	if override := policy.Services[service].Placement; override != nil {
+		placement = *override
+	}
+	if placement.Mode == "" {
+		placement.Mode = PlacementSingle
+	}
+	return placement
+}
+
+// merge returns a copy of the policy with all fields set in override replaced
+func (policy *LoadBalancerPolicy) merge(override *LoadBalancerPolicy) *LoadBalancerPolicy {
+	if policy == nil {
+		return override
+	}
+	if override == nil {
+		return policy
+	}
+
+	merged := *policy
+	if override.Replicas != nil {
+		merged.Replicas = override.Replicas
+	}
+	if override.Image != "" {
+		merged.Image = override.Image
+	}
+	if override.Resources != nil {
+		merged.Resources = override.Resources
+	}
+	if override.Autoscale != nil {
+		merged.Autoscale = override.Autoscale
+	}
+
+	merged.Environment = make(map[string]string)
+	for name, value := range policy.Environment {
+		merged.Environment[name] = value
+	}
+	for name, value := range override.Environment {
+		merged.Environment[name] = value
+	}
+	return &merged
+}
+
+// ReconcilePeriod returns how often a namespace is reconciled without a change event
+func (policies *Policies) ReconcilePeriod(namespace string) time.Duration {
+	if period := policies.Namespace(namespace).ReconcilePeriod.Duration; period != 0 {
+		return period
+	}
+	return GlobalConfig().Timing().ReconcilePeriod
+}
+
+func (policy *NamespacePolicy) validate() error {
+	if policy.ReconcilePeriod.Duration < 0 {
+		return fmt.Errorf("reconcilePeriod must not be negative")
+	}
+
+	if policy.Quota != nil {
+		err := policy.Quota.validate()
+		if err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+	}
+
+	if policy.LoadBalancer != nil {
+		err := policy.LoadBalancer.validate()
+		if err != nil {
+			return fmt.Errorf("loadBalancer: %w", err)
+		}
+	}
+
+	if policy.Rollout != nil {
+		err := policy.Rollout.validate()
+		if err != nil {
+			return fmt.Errorf("rollout: %w", err)
+		}
+	}
+
+	if policy.Placement != nil {
+		err := policy.Placement.validate()
+		if err != nil {
+			return fmt.Errorf("placement: %w", err)
+		}
+	}
+
+	for i := range policy.Overlays {
+		err := policy.Overlays[i].validate()
+		if err != nil {
+			return fmt.Errorf("overlay %d: %w", i, err)
+		}
+	}
+
+	for name, service := range policy.Services {
+		for i := range service.Overlays {
+			err := service.Overlays[i].validate()
+			if err != nil {
+				return fmt.Errorf("service %s: overlay %d: %w", name, i, err)
+			}
+		}
+		if service.Placement != nil {
+			err := service.Placement.validate()
+			if err != nil {
+				return fmt.Errorf("service %s: placement: %w", name, err)
+			}
+		}
+		if service.LoadBalancer != nil {
+			err := service.LoadBalancer.validate()
+			if err != nil {
+				return fmt.Errorf("service %s: loadBalancer: %w", name, err)
+			}
+		}
+		if service.Rollout != nil {
+			err := service.Rollout.validate()
+			if err != nil {
+				return fmt.Errorf("service %s: rollout: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (policy *PlacementPolicy) validate() error {
+	switch policy.Mode {
+	case "", PlacementSingle, PlacementAll, PlacementSpread:
+	default:
+		return fmt.Errorf("unknown mode %q", policy.Mode)
+	}
+	return nil
+}
+
+// checkClusters makes sure all placements only name configured clusters
+func (policies *Policies) checkClusters(clusters []string) error {
+	known := make(map[string]bool)
+	for _, name := range clusters {
+		known[name] = true
+	}
+	check := func(scope string, placement *PlacementPolicy) error {
+		if placement == nil {
+			return nil
+		}
+		for _, name := range placement.Clusters {
+			if !known[name] {
+				return fmt.Errorf("%s: placement: unknown cluster %q", scope, name)
+			}
+		}
+		return nil
+	}
+
+	scopes := map[string]NamespacePolicy{"defaults": policies.Defaults}
+	for name, policy := range policies.Namespaces {
+		scopes["namespace "+name] = policy
+	}
+	for scope, policy := range scopes {
+		err := check(scope, policy.Placement)
+		if err != nil {
+			return err
+		}
+		for name, service := range policy.Services {
+			err = check(fmt.Sprintf("%s: service %s", scope, name), service.Placement)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (overlay *Overlay) validate() error {
+	switch {
+	case len(overlay.StrategicMerge) > 0 && len(overlay.JSONPatch) > 0:
+		return fmt.Errorf("only one of strategicMerge and jsonPatch can be set")
+	case len(overlay.StrategicMerge) > 0:
+		patch := make(map[string]interface{})
+		err := json.Unmarshal(overlay.StrategicMerge, &patch)
+		if err != nil {
+			return fmt.Errorf("strategicMerge must be an object: %w", err)
+		}
+	case len(overlay.JSONPatch) > 0:
+		_, err := jsonpatch.DecodePatch(overlay.JSONPatch)
+		if err != nil {
+			return fmt.Errorf("invalid jsonPatch: %w", err)
+		}
+	default:
+		return fmt.Errorf("one of strategicMerge and jsonPatch must be set")
+	}
+	return nil
+}
+
+func (policy *RolloutPolicy) validate() error {
+	switch policy.Strategy {
+	case "", RolloutStrategyRollingUpdate, RolloutStrategyCanary, RolloutStrategyBlueGreen:
+	default:
+		return fmt.Errorf("unknown strategy %q", policy.Strategy)
+	}
+
+	if policy.Canary != nil {
+		if policy.Canary.Replicas < 0 || policy.Canary.MaxRestarts < 0 {
+			return fmt.Errorf("canary: limits must not be negative")
+		}
+		if policy.Canary.StepInterval.Duration < 0 {
+			return fmt.Errorf("canary: stepInterval must not be negative")
+		}
+		for _, weight := range policy.Canary.Steps {
+			if weight < 1 || weight > 100 {
+				return fmt.Errorf("canary: step weight %d is not between 1 and 100", weight)
+			}
+		}
+	}
+
+	if policy.BlueGreen != nil && policy.BlueGreen.GracePeriod.Duration < 0 {
+		return fmt.Errorf("blueGreen: gracePeriod must not be negative")
+	}
+
+	if policy.ProgressDeadline.Duration < 0 {
+		return fmt.Errorf("progressDeadline must not be negative")
+	}
+	return nil
+}
+
+func (policy *LoadBalancerPolicy) validate() error {
+	if policy.Replicas != nil && *policy.Replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1")
+	}
+
+	for name := range policy.Environment {
+		if name == "PORT" || name == "HTTP_PORT" {
+			return fmt.Errorf("environment variable %s is reserved", name)
+		}
+	}
+
+	if policy.Autoscale != nil {
+		autoscale := policy.Autoscale
+		if autoscale.ServiceReplicasPerLoadBalancer < 1 {
+			return fmt.Errorf("autoscale: serviceReplicasPerLoadBalancer must be at least 1")
+		}
+		if autoscale.MinReplicas < 0 || autoscale.MaxReplicas < 0 {
+			return fmt.Errorf("autoscale: limits must not be negative")
+		}
+		if autoscale.MaxReplicas > 0 && autoscale.MaxReplicas < autoscale.MinReplicas {
+			return fmt.Errorf("autoscale: maxReplicas must not be lower than minReplicas")
+		}
+	}
+	return nil
+}
+
+func (quota *Quota) validate() error {
+	if quota.MaxServices < 0 || quota.MaxReplicas < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+
+	quantities := map[string]string{
+		"cpu":           quota.CPU,
+		"memory":        quota.Memory,
+		"defaultCpu":    quota.DefaultCPU,
+		"defaultMemory": quota.DefaultMemory,
+	}
+	for name, value := range quantities {
+		if value == "" {
+			continue
+		}
+		_, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+	}
+
+	// Without default requests pods could not be admitted or accounted for
+	if quota.CPU != "" && quota.DefaultCPU == "" {
+		return fmt.Errorf("cpu requires defaultCpu to be set")
+	}
+	if quota.Memory != "" && quota.DefaultMemory == "" {
+		return fmt.Errorf("memory requires defaultMemory to be set")
+	}
+	return nil
+}
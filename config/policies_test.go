@@ -0,0 +1,34 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNamespaceMergesServicePolicies(t *testing.T) {
+	replicas := int32(3)
+	defaultOverlay := Overlay{StrategicMerge: json.RawMessage(`{"metadata":{"labels":{"team":"default"}}}`)}
+	namespaceOverlay := Overlay{StrategicMerge: json.RawMessage(`{"metadata":{"labels":{"team":"web"}}}`)}
+	policies := &Policies{
+		Defaults: NamespacePolicy{Services: map[string]ServicePolicy{
+			"web": {Placement: &PlacementPolicy{Mode: PlacementAll}, Overlays: []Overlay{defaultOverlay}},
+			"api": {Rollout: &RolloutPolicy{Strategy: RolloutStrategyCanary}},
+		}},
+		Namespaces: map[string]NamespacePolicy{"test": {Services: map[string]ServicePolicy{
+			"web": {LoadBalancer: &LoadBalancerPolicy{Replicas: &replicas}, Overlays: []Overlay{namespaceOverlay}},
+		}}},
+	}
+
+	if placement := policies.Placement("test", "web"); placement.Mode != PlacementAll {
+		t.Errorf("expected the default placement of web to be kept, got %s", placement.Mode)
+	}
+	if lb := policies.LoadBalancer("test", "web"); lb.Replicas == nil || *lb.Replicas != replicas {
+		t.Errorf("expected the namespace load balancer policy of web to be used")
+	}
+	if overlays := policies.Overlays("test", "web"); len(overlays) != 2 {
+		t.Errorf("expected the default and namespace overlays of web, got %d overlays", len(overlays))
+	}
+	if rollout := policies.Rollout("test", "api"); rollout.Strategy != RolloutStrategyCanary {
+		t.Errorf("expected the default rollout of api to be kept, got %s", rollout.Strategy)
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"bytes"
+	"github.com/kulycloud/common/logging"
+	"io/ioutil"
+	"reflect"
+)
+
+var logger = logging.GetForComponent("config")
+
+// Watcher detects changes to the config and policy file and applies the params that can be changed while running
+type Watcher struct {
+	contents map[string][]byte
+	// missing are the files that could not be read, they are reported as changed only once
+	missing map[string]bool
+}
+
+func NewWatcher() *Watcher {
+	watcher := &Watcher{
+		contents: make(map[string][]byte),
+		missing:  make(map[string]bool),
+	}
+	watcher.changed()
+	return watcher
+}
+
+// Check reloads the config if one of its files changed. It returns whether resources have to be rendered again.
+// An invalid file leaves the running config untouched.
+func (watcher *Watcher) Check() (bool, error) {
+	if !watcher.changed() {
+		return false, nil
+	}
+
+	parsed, policies, err := parse()
+	if err != nil {
+		return false, err
+	}
+
+	return apply(parsed, policies), nil
+}
+
+// changed reads the watched files and remembers their contents
+func (watcher *Watcher) changed() bool {
+	changed := false
+	for _, path := range []string{GlobalConfig().ConfigFile, GlobalConfig().PolicyFile} {
+		if path == "" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			// parse reports the error, a file that is replaced is missing for a moment
+			changed = changed || !watcher.missing[path]
+			watcher.missing[path] = true
+			continue
+		}
+		delete(watcher.missing, path)
+		if !bytes.Equal(watcher.contents[path], data) {
+			watcher.contents[path] = data
+			changed = true
+		}
+	}
+	return changed
+}
+
+// apply takes over the hot reloadable params and the policies. Other params keep their value until a restart.
+func apply(parsed *Config, policies *Policies) bool {
+	render := false
+	next := *GlobalConfig()
+
+	current := reflect.ValueOf(&next).Elem()
+	updated := reflect.ValueOf(parsed).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		if reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			continue
+		}
+
+		name := field.Tag.Get("configName")
+		reload, ok := field.Tag.Lookup("hotReload")
+		if !ok {
+			logger.Warnw("changed param requires a restart", "param", name)
+			continue
+		}
+
+		logger.Infow("reloading param", "param", name, "value", updated.Field(i).Interface())
+		current.Field(i).Set(updated.Field(i))
+		render = render || reload == "render"
+	}
+
+	if !reflect.DeepEqual(GlobalPolicies(), policies) {
+		logger.Info("reloading policies")
+		render = true
+	}
+
+	SetGlobal(&next, policies)
+	return render
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useGlobal sets the running config for the duration of a test
+func useGlobal(t *testing.T, config *Config, policies *Policies) {
+	previousConfig, previousPolicies := GlobalConfig(), GlobalPolicies()
+	t.Cleanup(func() {
+		SetGlobal(previousConfig, previousPolicies)
+	})
+	SetGlobal(config, policies)
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("could not write %s: %v", path, err)
+	}
+}
+
+func TestWatcherReportsMissingFileOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "httpPort: 30000\n")
+	useGlobal(t, &Config{ConfigFile: path}, &Policies{})
+	watcher := NewWatcher()
+
+	if watcher.changed() {
+		t.Errorf("unchanged file was reported as changed")
+	}
+
+	err := os.Remove(path)
+	if err != nil {
+		t.Fatalf("could not remove config file: %v", err)
+	}
+	if !watcher.changed() {
+		t.Errorf("missing file was not reported as changed")
+	}
+	if watcher.changed() {
+		t.Errorf("missing file was reported as changed again")
+	}
+
+	writeFile(t, path, "httpPort: 30001\n")
+	if !watcher.changed() {
+		t.Errorf("recreated file was not reported as changed")
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(config *Config, policies *Policies)
+		render   bool
+		value    func(config *Config) interface{}
+		expected interface{}
+	}{
+		{
+			name:     "render param",
+			change:   func(config *Config, policies *Policies) { config.LoadBalancerImage = "kuly/loadbalancer:2" },
+			render:   true,
+			value:    func(config *Config) interface{} { return config.LoadBalancerImage },
+			expected: "kuly/loadbalancer:2",
+		},
+		{
+			name:     "safe param",
+			change:   func(config *Config, policies *Policies) { config.RevisionHistoryLimit = 3 },
+			render:   false,
+			value:    func(config *Config) interface{} { return config.RevisionHistoryLimit },
+			expected: uint32(3),
+		},
+		{
+			name:     "restart param",
+			change:   func(config *Config, policies *Policies) { config.Port = 12271 },
+			render:   false,
+			value:    func(config *Config) interface{} { return config.Port },
+			expected: uint32(12270),
+		},
+		{
+			name: "policies",
+			change: func(config *Config, policies *Policies) {
+				policies.Defaults.Quota = &Quota{MaxServices: 5}
+			},
+			render:   true,
+			value:    func(config *Config) interface{} { return GlobalPolicies().Defaults.Quota.MaxServices },
+			expected: int32(5),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useGlobal(t, validConfig(), &Policies{})
+			parsed, policies := validConfig(), &Policies{}
+			test.change(parsed, policies)
+
+			render := apply(parsed, policies)
+			if render != test.render {
+				t.Errorf("expected render to be %v, got %v", test.render, render)
+			}
+			if value := test.value(GlobalConfig()); value != test.expected {
+				t.Errorf("expected %v after reload, got %v", test.expected, value)
+			}
+		})
+	}
+}
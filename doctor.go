@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"github.com/kulycloud/service-manager-k8s/reconciling"
+)
+
+// runDoctor prints the preflight report of the configured clusters without starting the manager
+func runDoctor() error {
+	err := config.ParseOfflineConfig()
+	if err != nil {
+		return err
+	}
+
+	reconciler, err := reconciling.NewReconciler(nil)
+	if err != nil {
+		return err
+	}
+
+	report := reconciler.Preflight(context.Background())
+	fmt.Print(report)
+	if report.Failed() {
+		return errors.New("preflight failed")
+	}
+	return nil
+}
@@ -3,9 +3,13 @@ module github.com/kulycloud/service-manager-k8s
 go 1.15
 
 require (
+	github.com/evanphx/json-patch v4.12.0+incompatible
 	github.com/kulycloud/common v0.0.0-20210323100819-93d825d597b5
 	github.com/kulycloud/protocol v0.0.0-20210323100304-4caa455444f5
+	google.golang.org/grpc v1.32.0
+	google.golang.org/protobuf v1.25.0
 	k8s.io/api v0.19.0
 	k8s.io/apimachinery v0.19.0
 	k8s.io/client-go v0.19.0
+	sigs.k8s.io/yaml v1.2.0
 )
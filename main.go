@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	commonCommunication "github.com/kulycloud/common/communication"
 	"github.com/kulycloud/common/logging"
 	"github.com/kulycloud/service-manager-k8s/communication"
 	"github.com/kulycloud/service-manager-k8s/config"
 	"github.com/kulycloud/service-manager-k8s/reconciling"
+	"os"
 )
 
 var logger = logging.GetForComponent("init")
@@ -14,14 +16,33 @@ var logger = logging.GetForComponent("init")
 func main() {
 	defer logging.Sync()
 
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		err := runRender()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		err := runDoctor()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err := config.ParseConfig()
 	if err != nil {
 		logger.Fatalw("Error parsing config", "error", err)
 	}
 	logger.Infow("Finished parsing config")
 
-	handlerErrStream := RegisterToControlPlane()
+	handler, handlerErrStream := RegisterToControlPlane()
 	scheduler := CreateSchedulerWithReconciler()
+	handler.SetReconciler(scheduler)
 	schedulerErrStream := scheduler.Start()
 
 	select {
@@ -34,16 +55,16 @@ func main() {
 	// die on error
 }
 
-func RegisterToControlPlane() <-chan error {
+func RegisterToControlPlane() (*communication.ServiceManagerHandler, <-chan error) {
 	communicator := commonCommunication.RegisterToControlPlane("service-manager",
-		config.GlobalConfig.Host, config.GlobalConfig.Port,
-		config.GlobalConfig.ControlPlaneHost, config.GlobalConfig.ControlPlanePort, true)
+		config.GlobalConfig().Host, config.GlobalConfig().Port,
+		config.GlobalConfig().ControlPlaneHost, config.GlobalConfig().ControlPlanePort, true)
 
 	listener := commonCommunication.NewListener(logging.GetForComponent("listener"))
 
 	logger.Info("Starting listener")
 
-	if err := listener.Setup(config.GlobalConfig.Port); err != nil {
+	if err := listener.Setup(config.GlobalConfig().Port); err != nil {
 		logger.Panicw("error initializing listener", "error", err)
 	}
 
@@ -53,13 +74,13 @@ func RegisterToControlPlane() <-chan error {
 	serveErr := listener.Serve()
 	communication.ControlPlane = <-communicator
 
-	return serveErr
+	return handler, serveErr
 }
 
 func CreateSchedulerWithReconciler() *reconciling.ReconcileScheduler {
 	ctx := context.Background()
 
-	reconciler, err := reconciling.NewKubernetesReconciler(communication.ControlPlane.Storage)
+	reconciler, err := reconciling.NewReconciler(communication.ControlPlane.Storage)
 	if err != nil {
 		logger.Fatalw("could not create reconciler", "error", err)
 	}
@@ -0,0 +1,280 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	commonCommunication "github.com/kulycloud/common/communication"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/client-go/tools/clientcmd"
+	"sort"
+	"sync"
+)
+
+// placementClusters returns the clusters a service is placed in
+func placementClusters(placement config.PlacementPolicy) []string {
+	clusters := placement.Clusters
+	if len(clusters) == 0 {
+		clusters = config.GlobalConfig().ClusterNames()
+	}
+	if placement.Mode == config.PlacementSingle && len(clusters) > 1 {
+		clusters = clusters[:1]
+	}
+	return clusters
+}
+
+// spreadReplicas returns the share of the replicas that is run by the cluster at the given index. The first clusters
+// run one more replica if the replicas cannot be divided evenly.
+func spreadReplicas(replicas uint32, clusters int, index int) uint32 {
+	share := replicas / uint32(clusters)
+	if uint32(index) < replicas%uint32(clusters) {
+		share++
+	}
+	return share
+}
+
+// placeService returns the service as it has to run in the cluster of the reconciler or false if it is not placed there
+func (r *KubernetesReconciler) placeService(name *protoStorage.NamespacedName, service *protoStorage.Service) (*protoStorage.Service, bool) {
+	if r.cluster == "" {
+		return service, true
+	}
+
+	placement := config.GlobalPolicies().Placement(name.Namespace, name.Name)
+	clusters := placementClusters(placement)
+	index := -1
+	for i, cluster := range clusters {
+		if cluster == r.cluster {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, false
+	}
+	if placement.Mode != config.PlacementSpread {
+		return service, true
+	}
+
+	replicas := spreadReplicas(service.Replicas, len(clusters), index)
+	if replicas == 0 && service.Replicas > 0 {
+		return nil, false // more clusters than replicas
+	}
+	placed := proto.Clone(service).(*protoStorage.Service)
+	placed.Replicas = replicas
+	return placed, true
+}
+
+// endpointAggregator combines the load balancers of a service in all clusters into the list that is kept in storage.
+// The endpoints are pod IPs, so the clusters need a flat pod network in which the pods of every cluster are routable
+// from the others.
+type endpointAggregator struct {
+	storage   Storage
+	mutex     sync.Mutex
+	endpoints map[string]map[string][]*protoCommon.Endpoint
+}
+
+func newEndpointAggregator(storage Storage) *endpointAggregator {
+	return &endpointAggregator{
+		storage:   storage,
+		endpoints: make(map[string]map[string][]*protoCommon.Endpoint),
+	}
+}
+
+func (aggregator *endpointAggregator) set(ctx context.Context, cluster string, namespace string, service string, endpoints []*protoCommon.Endpoint) error {
+	key := statusKey(namespace, service)
+
+	aggregator.mutex.Lock()
+	clusters, ok := aggregator.endpoints[key]
+	if !ok {
+		clusters = make(map[string][]*protoCommon.Endpoint)
+		aggregator.endpoints[key] = clusters
+	}
+	clusters[cluster] = endpoints
+
+	names := make([]string, 0, len(clusters))
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	combined := make([]*protoCommon.Endpoint, 0)
+	for _, name := range names {
+		combined = append(combined, clusters[name]...)
+	}
+	aggregator.mutex.Unlock()
+
+	return aggregator.storage.SetServiceLBEndpoints(ctx, namespace, service, combined)
+}
+
+var _ Reconciler = &MultiClusterReconciler{}
+
+// MultiClusterReconciler places services in several clusters and runs a KubernetesReconciler for each of them.
+// Pods only receive endpoints of their own cluster, the load balancers of all clusters are combined in storage.
+type MultiClusterReconciler struct {
+	clusters []*KubernetesReconciler
+}
+
+func NewMultiClusterReconciler(storage *commonCommunication.StorageCommunicator) (*MultiClusterReconciler, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if config.GlobalConfig().Kubeconfig != "" {
+		loadingRules.ExplicitPath = config.GlobalConfig().Kubeconfig
+	}
+
+	clusterStorage := &communicatorStorage{storage}
+	endpoints := newEndpointAggregator(clusterStorage)
+	freeze := newFreezeState()
+	multi := &MultiClusterReconciler{}
+	for _, name := range config.GlobalConfig().ClusterNames() {
+		logger.Infow("using kubeconfig context", "cluster", name)
+		configObj, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: name}).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config of cluster %s: %w", name, err)
+		}
+
+		reconciler, err := newKubernetesReconcilerForConfig(clusterStorage, configObj, name)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", name, err)
+		}
+		reconciler.endpoints = endpoints
+		reconciler.freeze = freeze
+		multi.clusters = append(multi.clusters, reconciler)
+	}
+
+	return multi, nil
+}
+
+// each runs f for every cluster and returns the first error
+func (multi *MultiClusterReconciler) each(f func(r *KubernetesReconciler) error) error {
+	errs := make([]error, 0)
+	for _, r := range multi.clusters {
+		err := f(r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", r.cluster, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed in %d of %d clusters, first error: %w", len(errs), len(multi.clusters), errs[0])
+	}
+	return nil
+}
+
+// primary returns the reconciler of the first cluster a service is placed in. It keeps the revision history of the service.
+func (multi *MultiClusterReconciler) primary(namespace string, name string) *KubernetesReconciler {
+	clusters := placementClusters(config.GlobalPolicies().Placement(namespace, name))
+	for _, r := range multi.clusters {
+		if len(clusters) > 0 && r.cluster == clusters[0] {
+			return r
+		}
+	}
+	return multi.clusters[0]
+}
+
+func (multi *MultiClusterReconciler) CheckAndSetup(ctx context.Context) error {
+	return multi.each(func(r *KubernetesReconciler) error {
+		return r.CheckAndSetup(ctx)
+	})
+}
+
+func (multi *MultiClusterReconciler) Preflight(ctx context.Context) *PreflightReport {
+	report := &PreflightReport{}
+	for _, r := range multi.clusters {
+		report.Checks = append(report.Checks, r.Preflight(ctx).Checks...)
+	}
+	return report
+}
+
+func (multi *MultiClusterReconciler) ReconcileDeployments(ctx context.Context, namespace string) error {
+	return multi.each(func(r *KubernetesReconciler) error {
+		return r.ReconcileDeployments(ctx, namespace)
+	})
+}
+
+func (multi *MultiClusterReconciler) ReconcileService(ctx context.Context, namespace string, name string) error {
+	return multi.each(func(r *KubernetesReconciler) error {
+		return r.ReconcileService(ctx, namespace, name)
+	})
+}
+
+// ConfirmDeletion confirms the blocked deletions in every cluster that has some
+func (multi *MultiClusterReconciler) ConfirmDeletion(ctx context.Context, namespace string) error {
+	confirmed := 0
+	err := multi.each(func(r *KubernetesReconciler) error {
+		err := r.ConfirmDeletion(ctx, namespace)
+		if errors.Is(err, ErrNoBlockedDeletions) {
+			return nil
+		}
+		confirmed++
+		return err
+	})
+	if err == nil && confirmed == 0 {
+		return fmt.Errorf("%w in namespace %s", ErrNoBlockedDeletions, namespace)
+	}
+	return err
+}
+
+func (multi *MultiClusterReconciler) ResyncLoadBalancers(ctx context.Context, namespace string) error {
+	return multi.each(func(r *KubernetesReconciler) error {
+		return r.ResyncLoadBalancers(ctx, namespace)
+	})
+}
+
+func (multi *MultiClusterReconciler) ReconcileNamespaces(ctx context.Context, namespaces []string) error {
+	return multi.each(func(r *KubernetesReconciler) error {
+		return r.ReconcileNamespaces(ctx, namespaces)
+	})
+}
+
+func (multi *MultiClusterReconciler) ReconcileRollouts(ctx context.Context) error {
+	return multi.each(func(r *KubernetesReconciler) error {
+		return r.ReconcileRollouts(ctx)
+	})
+}
+
+func (multi *MultiClusterReconciler) PropagateStorageToLoadBalancers(ctx context.Context, endpoints []*protoCommon.Endpoint) {
+	for _, r := range multi.clusters {
+		r.PropagateStorageToLoadBalancers(ctx, endpoints)
+	}
+}
+
+// Freeze freezes all clusters at once, they share their frozen state
+func (multi *MultiClusterReconciler) Freeze(reason string) {
+	multi.clusters[0].Freeze(reason)
+}
+
+// Thaw thaws the shared frozen state once and resyncs the load balancers of all clusters
+func (multi *MultiClusterReconciler) Thaw(ctx context.Context) error {
+	if !multi.clusters[0].thaw() {
+		return nil
+	}
+	return multi.each(func(r *KubernetesReconciler) error {
+		return r.resyncLoadBalancers(ctx)
+	})
+}
+
+func (multi *MultiClusterReconciler) Frozen() bool {
+	return multi.clusters[0].Frozen()
+}
+
+// MonitorCluster watches the pods of every cluster with its own informer
+func (multi *MultiClusterReconciler) MonitorCluster(ctx context.Context) error {
+	errs := make(chan error, len(multi.clusters))
+	for _, r := range multi.clusters {
+		go func(r *KubernetesReconciler) {
+			err := r.MonitorCluster(ctx)
+			if err != nil {
+				err = fmt.Errorf("cluster %s: %w", r.cluster, err)
+			}
+			errs <- err
+		}(r)
+	}
+
+	for range multi.clusters {
+		err := <-errs
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package reconciling
+
+import (
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"testing"
+)
+
+func TestSpreadReplicas(t *testing.T) {
+	tests := []struct {
+		replicas uint32
+		clusters int
+		shares   []uint32
+	}{
+		{replicas: 6, clusters: 3, shares: []uint32{2, 2, 2}},
+		{replicas: 7, clusters: 3, shares: []uint32{3, 2, 2}},
+		{replicas: 8, clusters: 3, shares: []uint32{3, 3, 2}},
+		{replicas: 2, clusters: 3, shares: []uint32{1, 1, 0}},
+		{replicas: 0, clusters: 2, shares: []uint32{0, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d replicas in %d clusters", test.replicas, test.clusters), func(t *testing.T) {
+			total := uint32(0)
+			for i, expected := range test.shares {
+				share := spreadReplicas(test.replicas, test.clusters, i)
+				if share != expected {
+					t.Errorf("expected cluster %d to run %d replicas, got %d", i, expected, share)
+				}
+				total += share
+			}
+			if total != test.replicas {
+				t.Errorf("expected the shares to add up to %d, got %d", test.replicas, total)
+			}
+		})
+	}
+}
+
+func TestPlaceService(t *testing.T) {
+	previousConfig, previousPolicies := config.GlobalConfig(), config.GlobalPolicies()
+	t.Cleanup(func() {
+		config.SetGlobal(previousConfig, previousPolicies)
+	})
+	clusters := &config.Config{Clusters: "a,b,c"}
+	name := &protoStorage.NamespacedName{Namespace: "test", Name: "web"}
+
+	tests := []struct {
+		name      string
+		placement config.PlacementPolicy
+		replicas  uint32
+		// placed are the replicas per cluster, clusters without an entry do not run the service
+		placed map[string]uint32
+	}{
+		{
+			name:      "single uses the first cluster",
+			placement: config.PlacementPolicy{Mode: config.PlacementSingle},
+			replicas:  3,
+			placed:    map[string]uint32{"a": 3},
+		},
+		{
+			name:      "single uses the first listed cluster",
+			placement: config.PlacementPolicy{Mode: config.PlacementSingle, Clusters: []string{"c", "a"}},
+			replicas:  3,
+			placed:    map[string]uint32{"c": 3},
+		},
+		{
+			name:      "all runs every replica everywhere",
+			placement: config.PlacementPolicy{Mode: config.PlacementAll},
+			replicas:  2,
+			placed:    map[string]uint32{"a": 2, "b": 2, "c": 2},
+		},
+		{
+			name:      "all in listed clusters",
+			placement: config.PlacementPolicy{Mode: config.PlacementAll, Clusters: []string{"b", "c"}},
+			replicas:  2,
+			placed:    map[string]uint32{"b": 2, "c": 2},
+		},
+		{
+			name:      "spread gives the remainder to the first clusters",
+			placement: config.PlacementPolicy{Mode: config.PlacementSpread},
+			replicas:  5,
+			placed:    map[string]uint32{"a": 2, "b": 2, "c": 1},
+		},
+		{
+			name:      "spread skips clusters without replicas",
+			placement: config.PlacementPolicy{Mode: config.PlacementSpread},
+			replicas:  2,
+			placed:    map[string]uint32{"a": 1, "b": 1},
+		},
+		{
+			name:      "spread of a scaled down service",
+			placement: config.PlacementPolicy{Mode: config.PlacementSpread, Clusters: []string{"a", "b"}},
+			replicas:  0,
+			placed:    map[string]uint32{"a": 0, "b": 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			placement := test.placement
+			config.SetGlobal(clusters, &config.Policies{Defaults: config.NamespacePolicy{Placement: &placement}})
+
+			for _, cluster := range []string{"a", "b", "c"} {
+				r := &KubernetesReconciler{cluster: cluster}
+				service := &protoStorage.Service{Image: "nginx", Replicas: test.replicas}
+				placed, ok := r.placeService(name, service)
+
+				expected, shouldPlace := test.placed[cluster]
+				if ok != shouldPlace {
+					t.Errorf("cluster %s: expected placed to be %v, got %v", cluster, shouldPlace, ok)
+					continue
+				}
+				if ok && placed.Replicas != expected {
+					t.Errorf("cluster %s: expected %d replicas, got %d", cluster, expected, placed.Replicas)
+				}
+				if service.Replicas != test.replicas {
+					t.Errorf("cluster %s: the service from storage was changed", cluster)
+				}
+			}
+		})
+	}
+}
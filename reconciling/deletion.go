@@ -0,0 +1,160 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	EventDeletionBlocked = "DeletionBlocked"
+	TriggerConfirmation  = "confirmation"
+	// NamespaceDeletions is the key the deletion of whole namespaces is guarded and confirmed with
+	NamespaceDeletions = ""
+)
+
+var (
+	ErrDeletionBlocked    = errors.New("deletion blocked")
+	ErrNoBlockedDeletions = errors.New("no blocked deletions")
+)
+
+// deletionGuard holds back reconciles that would delete a large part of a namespace at once,
+// which usually means storage returned an empty or truncated service list
+type deletionGuard struct {
+	mutex sync.Mutex
+	// pending are the deletions that have been blocked, by namespace
+	pending map[string][]string
+	// confirmed are the deletions that may go ahead on the next reconcile, by namespace
+	confirmed map[string][]string
+}
+
+func newDeletionGuard() *deletionGuard {
+	return &deletionGuard{
+		pending:   make(map[string][]string),
+		confirmed: make(map[string][]string),
+	}
+}
+
+// exceedsThreshold reports whether deleting some of the total deployed services needs a confirmation.
+// The percentage is only applied to more than one deletion so removing the last service of a namespace is not blocked.
+func exceedsThreshold(deletions int, total int) bool {
+	limit := config.GlobalConfig().DeletionGuardServices
+	if limit > 0 && deletions > int(limit) {
+		return true
+	}
+
+	percent := config.GlobalConfig().DeletionGuardPercent
+	return percent > 0 && deletions > 1 && deletions*100 > total*int(percent)
+}
+
+// check returns ErrDeletionBlocked if the deletions exceed the threshold and have not been confirmed.
+// The second return value is true if the deletions have not been blocked before.
+func (guard *deletionGuard) check(namespace string, deletions []string, total int) (bool, error) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	if len(deletions) == 0 || !exceedsThreshold(len(deletions), total) || config.GlobalPolicies().Namespace(namespace).AllowMassDeletion {
+		delete(guard.pending, namespace)
+		return false, nil
+	}
+
+	if covers(guard.confirmed[namespace], deletions) {
+		delete(guard.pending, namespace)
+		delete(guard.confirmed, namespace)
+		return false, nil
+	}
+
+	changed := !equalNames(guard.pending[namespace], deletions)
+	guard.pending[namespace] = deletions
+	if namespace == NamespaceDeletions {
+		return changed, fmt.Errorf("%w: %d of %d namespaces would be deleted", ErrDeletionBlocked, len(deletions), total)
+	}
+	return changed, fmt.Errorf("%w: %d of %d services in namespace %s would be deleted", ErrDeletionBlocked, len(deletions), total, namespace)
+}
+
+// confirm allows the blocked deletions of a namespace once
+func (guard *deletionGuard) confirm(namespace string) ([]string, error) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	pending, ok := guard.pending[namespace]
+	if !ok {
+		return nil, fmt.Errorf("%w in namespace %s", ErrNoBlockedDeletions, namespace)
+	}
+	guard.confirmed[namespace] = pending
+	return pending, nil
+}
+
+// covers reports whether every deletion has been confirmed
+func covers(confirmed []string, deletions []string) bool {
+	allowed := make(map[string]bool, len(confirmed))
+	for _, name := range confirmed {
+		allowed[name] = true
+	}
+	for _, name := range deletions {
+		if !allowed[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalNames(a []string, b []string) bool {
+	return len(a) == len(b) && covers(a, b)
+}
+
+// guardDeletions fails if the deletions of a namespace are blocked. Newly blocked deletions are reported as an alert.
+func (r *KubernetesReconciler) guardDeletions(ctx context.Context, namespace string, deletions []string, deployed int, live map[string]*appsv1.Deployment) error {
+	sort.Strings(deletions)
+	alert, err := r.deletions.check(namespace, deletions, deployed)
+	if err == nil || !alert {
+		return err
+	}
+
+	message := fmt.Sprintf("Deletion of %d services blocked: %s. Confirm the deletion or allow mass deletion for the namespace.", len(deletions), strings.Join(deletions, ", "))
+	logger.Errorw("blocked mass deletion", "namespace", namespace, "services", deletions, "deployed", deployed)
+	for _, name := range deletions {
+		deployment, ok := live[serviceDeploymentName(&protoStorage.NamespacedName{Namespace: namespace, Name: name})]
+		if ok {
+			r.recordEvent(ctx, deployment, corev1.EventTypeWarning, EventDeletionBlocked, message)
+		}
+	}
+	return err
+}
+
+// guardNamespaceDeletions fails if the deletion of kubernetes namespaces is blocked, they are guarded with the
+// same thresholds as the services of a namespace
+func (r *KubernetesReconciler) guardNamespaceDeletions(deletions []string, existing int) error {
+	sort.Strings(deletions)
+	alert, err := r.deletions.check(NamespaceDeletions, deletions, existing)
+	if err == nil || !alert {
+		return err
+	}
+
+	logger.Errorw("blocked mass deletion of namespaces", "namespaces", deletions, "existing", existing)
+	return err
+}
+
+// ConfirmDeletion lets the deletions blocked by the deletion guard go ahead and reconciles the namespace.
+// Blocked namespace deletions are confirmed with NamespaceDeletions and carried out by the next reconcile
+// of all namespaces, only it knows which namespaces exist.
+func (r *KubernetesReconciler) ConfirmDeletion(ctx context.Context, namespace string) error {
+	names, err := r.deletions.confirm(namespace)
+	if err != nil {
+		return err
+	}
+
+	if namespace == NamespaceDeletions {
+		logger.Infow("confirmed deletion of namespaces", "namespaces", names)
+		return nil
+	}
+	logger.Infow("confirmed deletion", "namespace", namespace, "services", names)
+	return r.ReconcileDeployments(WithTrigger(ctx, TriggerConfirmation), namespace)
+}
@@ -0,0 +1,113 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"k8s.io/apimachinery/pkg/types"
+	"testing"
+)
+
+func (environment *testEnvironment) deployServices(t *testing.T, names ...string) {
+	for _, name := range names {
+		_ = environment.storage.SetService(context.Background(), testNamespace, name, &protoStorage.Service{Image: name, Replicas: 1})
+	}
+	environment.reconcile(t)
+}
+
+func TestDeletionGuardBlocksMassDeletion(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	config.GlobalConfig().DeletionGuardPercent = 50
+	ctx := context.Background()
+
+	environment.deployServices(t, "web", "api", "worker", "cron")
+	for _, name := range []string{"api", "worker", "cron"} {
+		environment.storage.deleteService(testNamespace, name)
+	}
+
+	err := environment.reconciler.ReconcileDeployments(ctx, testNamespace)
+	if !errors.Is(err, ErrDeletionBlocked) {
+		t.Fatalf("expected the deletion to be blocked, got %v", err)
+	}
+	removed := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "api"}
+	if !environment.deploymentExists(t, serviceDeploymentName(removed)) {
+		t.Fatalf("deployment was deleted despite the guard")
+	}
+
+	if environment.recordedEvents(t, EventDeletionBlocked) == 0 {
+		t.Errorf("expected a %s event", EventDeletionBlocked)
+	}
+
+	err = environment.reconciler.ConfirmDeletion(ctx, testNamespace)
+	if err != nil {
+		t.Fatalf("could not confirm deletion: %v", err)
+	}
+	if environment.deploymentExists(t, serviceDeploymentName(removed)) {
+		t.Errorf("deployment still exists after the deletion was confirmed")
+	}
+	if !environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"})) {
+		t.Errorf("deployment of remaining service was deleted")
+	}
+
+	err = environment.reconciler.ConfirmDeletion(ctx, testNamespace)
+	if !errors.Is(err, ErrNoBlockedDeletions) {
+		t.Errorf("expected a confirmation to be used only once, got %v", err)
+	}
+}
+
+func TestDeletionGuardPolicyOverride(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	config.GlobalConfig().DeletionGuardServices = 1
+	config.GlobalPolicies().Namespaces = map[string]config.NamespacePolicy{testNamespace: {AllowMassDeletion: true}}
+
+	environment.deployServices(t, "web", "api", "worker")
+	environment.storage.deleteService(testNamespace, "api")
+	environment.storage.deleteService(testNamespace, "worker")
+	environment.reconcile(t)
+
+	if environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "api"})) {
+		t.Errorf("deletion was blocked although the namespace allows mass deletion")
+	}
+}
+
+func TestDeletionGuardIgnoresPlacementMoves(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	config.GlobalConfig().DeletionGuardPercent = 50
+	config.GlobalConfig().Clusters = "a,b"
+	environment.reconciler.cluster = "a"
+	environment.deployServices(t, "web", "api", "worker", "cron")
+
+	// all services move to the other cluster while they still exist in storage
+	config.GlobalPolicies().Defaults.Placement = &config.PlacementPolicy{Mode: config.PlacementSingle, Clusters: []string{"b"}}
+	environment.reconcile(t)
+
+	for _, name := range []string{"web", "api", "worker", "cron"} {
+		if environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: name})) {
+			t.Errorf("deployment of %s was kept after the service moved to another cluster", name)
+		}
+	}
+}
+
+func TestDeletionGuardCoversEventDrivenReconciles(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	config.GlobalConfig().DeletionGuardPercent = 50
+	environment.deployServices(t, "web", "api", "worker", "cron")
+
+	// storage returns a truncated service list while the resources of the missing services change,
+	// each change queues a reconcile of a single service
+	removed := []string{"api", "worker", "cron"}
+	for _, name := range removed {
+		environment.storage.deleteService(testNamespace, name)
+		environment.reconciler.cache.queue.Add(types.NamespacedName{Namespace: testNamespace, Name: name})
+	}
+	for environment.reconciler.cache.queue.Len() > 0 {
+		environment.reconciler.processNextService(context.Background())
+	}
+
+	for _, name := range removed {
+		if !environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: name})) {
+			t.Errorf("deployment of %s was deleted despite the guard", name)
+		}
+	}
+}
@@ -5,106 +5,314 @@ import (
 	"fmt"
 	protoStorage "github.com/kulycloud/protocol/storage"
 	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
 )
 
 func (r *KubernetesReconciler) ReconcileDeployments(ctx context.Context, namespace string) error {
-	// Storage should be ready
-	serviceNames, err := r.storage.GetServicesInNamespace(ctx, namespace)
+	// All services are read before anything is changed so a failing storage cannot leave a half updated namespace
+	serviceNames, services, err := r.readNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	err = r.ensureNamespace(ctx, namespace)
 	if err != nil {
 		return err
 	}
 
-	deploymentsClient := r.clientset.AppsV1().Deployments(config.GlobalConfig.ServiceNamespace)
-	secretsClient := r.clientset.CoreV1().Secrets(config.GlobalConfig.ServiceNamespace)
+	err = r.reconcileQuota(ctx, namespace)
+	if err != nil {
+		return err
+	}
 
-	deployments, err := deploymentsClient.List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s,%s=%s", typeLabel, typeLabelService, namespaceLabel, namespace)})
+	deployments, err := r.listDeployments(ctx, namespace, fmt.Sprintf("%s=%s,%s=%s", typeLabel, typeLabelService, namespaceLabel, labelValue(namespace)))
 	if err != nil {
 		return err
 	}
 
 	updated := make(map[string]bool)
-	for _, dep := range deployments.Items {
-		updated[dep.Name] = false
+	live := make(map[string]*appsv1.Deployment)
+	for _, dep := range deployments {
+		_, depName := owner(dep)
+		updated[depName] = false
+		live[dep.Name] = dep
 	}
+	deployed := len(updated)
 
+	// Existing services are admitted first so new services cannot push them out of the quota
+	sort.SliceStable(serviceNames, func(i, j int) bool {
+		_, iExisting := updated[serviceNames[i]]
+		_, jExisting := updated[serviceNames[j]]
+		return iExisting && !jExisting
+	})
+	quota := newQuotaTracker(config.GlobalPolicies().Namespace(namespace).Quota)
+
+	// services moved to other clusters are still in storage, their deletion is not guarded
+	moved := make([]string, 0)
 	for _, name := range serviceNames {
 		namespacedName := &protoStorage.NamespacedName{
 			Namespace: namespace,
 			Name:      name,
 		}
 
-		serviceName := serviceDeploymentName(namespacedName)
-		_, existing := updated[serviceName]
-		updated[serviceName] = true
-
-		service, err := r.storage.GetService(ctx, namespace, name)
-		if err != nil {
-			continue
-		}
+		_, existing := updated[name]
+		updated[name] = true
 
-		if service.PullSecrets != "" {
-			pullSecrets := buildPullSecrets(namespacedName, service)
+		service, placed := r.placeService(namespacedName, services[name])
+		if !placed {
 			if existing {
-				_, err = secretsClient.Update(ctx, pullSecrets, metav1.UpdateOptions{})
-			} else {
-				_, err = secretsClient.Create(ctx, pullSecrets, metav1.CreateOptions{})
+				moved = append(moved, name)
 			}
-			if err != nil {
-				logger.Warnw("Could not update/create PullSecret", "err", err, "existing", existing, "namespacedName", namespacedName)
-				continue
-			}
-		}
-
-		deployment := buildDeploymentFromService(namespacedName, service)
-
-		if existing {
-			_, err = deploymentsClient.Update(ctx, deployment, metav1.UpdateOptions{})
-		} else {
-			_, err = deploymentsClient.Create(ctx, deployment, metav1.CreateOptions{})
-		}
-		if err != nil {
-			logger.Warnw("Could not update/create Deployment", "err", err, "existing", existing, "namespacedName", namespacedName)
 			continue
 		}
 
-		loadbalancer := buildLoadBalancerDeploymentFromService(namespacedName, service)
-		if existing {
-			_, err = deploymentsClient.Update(ctx, loadbalancer, metav1.UpdateOptions{})
-		} else {
-			_, err = deploymentsClient.Create(ctx, loadbalancer, metav1.CreateOptions{})
-		}
-		if err != nil {
-			logger.Warnw("Could not update/create LoadBalancer", "err", err, "existing", existing, "namespacedName", namespacedName)
-			continue
+		err = r.reconcileService(ctx, namespacedName, service, live[serviceDeploymentName(namespacedName)], quota)
+		if apiErrors.IsConflict(err) {
+			// the deployment was listed from a stale cache, the service is reconciled again once the cache caught up
+			r.cache.queue.AddRateLimited(types.NamespacedName{Namespace: namespace, Name: name})
 		}
+	}
 
+	for _, name := range moved {
+		// delete service that has been moved to other clusters
+		r.deleteService(ctx, &protoStorage.NamespacedName{
+			Namespace: namespace,
+			Name:      name,
+		})
 	}
 
+	deletions := make([]string, 0)
 	for name, handled := range updated {
 		if handled == true {
 			continue
 		}
+		deletions = append(deletions, name)
+	}
+
+	err = r.guardDeletions(ctx, namespace, deletions, deployed-len(moved), live)
+	if err != nil {
+		return err
+	}
 
+	for _, name := range deletions {
 		// delete service that no longer exists
-		namespacedName := &protoStorage.NamespacedName{
+		r.deleteService(ctx, &protoStorage.NamespacedName{
 			Namespace: namespace,
 			Name:      name,
-		}
+		})
+	}
+
+	return nil
+}
+
+// readNamespace reads all services of a namespace from storage and fails if any of them cannot be read
+func (r *KubernetesReconciler) readNamespace(ctx context.Context, namespace string) ([]string, map[string]*protoStorage.Service, error) {
+	serviceNames, err := r.storage.GetServicesInNamespace(ctx, namespace)
+	if err != nil {
+		return nil, nil, r.storageFailed(fmt.Errorf("%w: namespace %s: %v", ErrStorageRead, namespace, err))
+	}
 
-		err := deploymentsClient.Delete(ctx, serviceDeploymentName(namespacedName), metav1.DeleteOptions{})
+	services := make(map[string]*protoStorage.Service, len(serviceNames))
+	for _, name := range serviceNames {
+		service, err := r.storage.GetService(ctx, namespace, name)
 		if err != nil {
-			logger.Warnw("Could not delete Deployment", "err", err, "namespacedName", namespacedName)
+			return nil, nil, r.storageFailed(fmt.Errorf("%w: service %s/%s: %v", ErrStorageRead, namespace, name, err))
+		}
+		services[name] = service
+	}
+	return serviceNames, services, nil
+}
+
+// storageFailed freezes the load balancers since storage cannot be relied on
+func (r *KubernetesReconciler) storageFailed(err error) error {
+	r.Freeze(err.Error())
+	return err
+}
+
+// ReconcileService reconciles a single service without touching the rest of its namespace
+func (r *KubernetesReconciler) ReconcileService(ctx context.Context, namespace string, name string) error {
+	namespacedName := &protoStorage.NamespacedName{
+		Namespace: namespace,
+		Name:      name,
+	}
+
+	serviceNames, err := r.storage.GetServicesInNamespace(ctx, namespace)
+	if err != nil {
+		return r.storageFailed(fmt.Errorf("%w: namespace %s: %v", ErrStorageRead, namespace, err))
+	}
+
+	found := false
+	for _, serviceName := range serviceNames {
+		if serviceName == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		// a service missing from storage is deleted by reconciling its namespace, so the deletion guard sees
+		// all deletions of a truncated service list at once instead of one at a time
+		return r.ReconcileDeployments(ctx, namespace)
+	}
+
+	service, err := r.storage.GetService(ctx, namespace, name)
+	if err != nil {
+		return r.storageFailed(fmt.Errorf("%w: service %s/%s: %v", ErrStorageRead, namespace, name, err))
+	}
+
+	service, placed := r.placeService(namespacedName, service)
+	if !placed {
+		r.deleteService(ctx, namespacedName)
+		return nil
+	}
+
+	err = r.ensureNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	deployments, err := r.listDeployments(ctx, namespace, fmt.Sprintf("%s=%s,%s=%s,%s!=%s", typeLabel, typeLabelService, namespaceLabel, labelValue(namespace), trackLabel, trackCanary))
+	if err != nil {
+		return err
+	}
+
+	// The other services of the namespace are accounted for with their deployed replica count
+	quota := newQuotaTracker(config.GlobalPolicies().Namespace(namespace).Quota)
+	var live *appsv1.Deployment
+	for _, dep := range deployments {
+		_, depName := owner(dep)
+		if dep.Name != serviceDeploymentName(&protoStorage.NamespacedName{Namespace: namespace, Name: depName}) {
+			continue // legacy deployments are replaced and not accounted for
+		}
+		if depName == name {
+			live = dep
+			continue
 		}
+		if dep.Spec.Replicas != nil {
+			_ = quota.admit(uint32(*dep.Spec.Replicas))
+		}
+	}
+
+	return r.reconcileService(ctx, namespacedName, service, live, quota)
+}
 
-		err = deploymentsClient.Delete(ctx, serviceLBDeploymentName(namespacedName), metav1.DeleteOptions{})
+// reconcileService creates or updates all resources of a service and records the outcome as its status
+func (r *KubernetesReconciler) reconcileService(ctx context.Context, namespacedName *protoStorage.NamespacedName, service *protoStorage.Service, live *appsv1.Deployment, quota *quotaTracker) error {
+	namespace := namespacedName.Namespace
+	name := namespacedName.Name
+	existing := live != nil
+	deploymentsClient := r.clientset.AppsV1().Deployments(targetNamespace(namespace))
+
+	live, err := r.liveDeployment(ctx, namespacedName, live)
+	if err != nil {
+		logger.Warnw("Could not get Deployment", "err", err, "namespacedName", namespacedName)
+		r.statuses.set(namespace, name, StatusFailed, err.Error())
+		return err
+	}
+	existing = live != nil
+
+	err = quota.admit(service.Replicas)
+	if err != nil {
+		logger.Warnw("Service exceeds quota", "err", err, "namespacedName", namespacedName)
+		r.statuses.set(namespace, name, StatusQuotaExceeded, err.Error())
+		return err
+	}
+
+	if service.PullSecrets != "" {
+		err = r.applySecret(ctx, buildPullSecrets(namespacedName, service))
 		if err != nil {
-			logger.Warnw("Could not delete LoadBalancer", "err", err, "namespacedName", namespacedName)
+			logger.Warnw("Could not update/create PullSecret", "err", err, "existing", existing, "namespacedName", namespacedName)
+			r.statuses.set(namespace, name, StatusFailed, err.Error())
+			return err
 		}
+	}
+
+	deployment, err := applyOverlays(buildDeploymentFromService(namespacedName, service), config.GlobalPolicies().Overlays(namespace, name))
+	if err != nil {
+		logger.Warnw("Could not apply overlays", "err", err, "namespacedName", namespacedName)
+		r.statuses.set(namespace, name, StatusFailed, err.Error())
+		return err
+	}
+	preserveAnnotations(deployment, live)
+	deployment, err = r.applyRolloutStrategy(ctx, namespacedName, service, deployment, live)
+	if err != nil {
+		logger.Warnw("Could not apply rollout strategy", "err", err, "namespacedName", namespacedName)
+		r.statuses.set(namespace, name, StatusFailed, err.Error())
+		return err
+	}
+
+	err = r.applyDeployment(ctx, deployment, live)
+	if err != nil {
+		logger.Warnw("Could not update/create Deployment", "err", err, "existing", existing, "namespacedName", namespacedName)
+		r.statuses.set(namespace, name, StatusFailed, err.Error())
+		return err
+	}
+
+	loadbalancer := buildLoadBalancerDeploymentFromService(namespacedName, service)
+	liveLoadBalancer, err := deploymentsClient.Get(ctx, loadbalancer.Name, metav1.GetOptions{})
+	if apiErrors.IsNotFound(err) {
+		liveLoadBalancer, err = nil, nil
+	}
+	if err == nil {
+		err = r.applyDeployment(ctx, loadbalancer, liveLoadBalancer)
+	}
+	if err != nil {
+		logger.Warnw("Could not update/create LoadBalancer", "err", err, "existing", existing, "namespacedName", namespacedName)
+		r.statuses.set(namespace, name, StatusFailed, err.Error())
+		return err
+	}
 
-		// This will probably throw errors quite often. Still cheaper than to check whether there are pull secrets before
-		_ = secretsClient.Delete(ctx, pullSecretName(namespacedName), metav1.DeleteOptions{})
+	err = r.migrateLegacyResources(ctx, namespacedName)
+	if err != nil {
+		logger.Warnw("Could not migrate legacy resources", "err", err, "namespacedName", namespacedName)
+	}
+
+	err = r.recordRevision(ctx, namespacedName, service)
+	if err != nil {
+		logger.Warnw("Could not record revision", "err", err, "namespacedName", namespacedName)
 	}
 
+	phase, message := rolloutStatus(deployment)
+	r.statuses.set(namespace, name, phase, message)
 	return nil
 }
+
+// deleteService removes all resources of a service that no longer exists in storage
+func (r *KubernetesReconciler) deleteService(ctx context.Context, namespacedName *protoStorage.NamespacedName) {
+	deploymentsClient := r.clientset.AppsV1().Deployments(targetNamespace(namespacedName.Namespace))
+	secretsClient := r.clientset.CoreV1().Secrets(targetNamespace(namespacedName.Namespace))
+
+	err := deploymentsClient.Delete(ctx, serviceDeploymentName(namespacedName), metav1.DeleteOptions{})
+	if err != nil && !apiErrors.IsNotFound(err) {
+		logger.Warnw("Could not delete Deployment", "err", err, "namespacedName", namespacedName)
+	}
+
+	err = deploymentsClient.Delete(ctx, serviceLBDeploymentName(namespacedName), metav1.DeleteOptions{})
+	if err != nil && !apiErrors.IsNotFound(err) {
+		logger.Warnw("Could not delete LoadBalancer", "err", err, "namespacedName", namespacedName)
+	}
+
+	err = r.deleteCanary(ctx, namespacedName)
+	if err != nil {
+		logger.Warnw("Could not delete canary", "err", err, "namespacedName", namespacedName)
+	}
+
+	// This will probably throw errors quite often. Still cheaper than to check whether there are pull secrets before
+	_ = secretsClient.Delete(ctx, pullSecretName(namespacedName), metav1.DeleteOptions{})
+	_ = secretsClient.Delete(ctx, historySecretName(namespacedName), metav1.DeleteOptions{})
+
+	for _, legacy := range []string{legacyServiceDeploymentName(namespacedName), legacyServiceLBDeploymentName(namespacedName), legacyCanaryDeploymentName(namespacedName)} {
+		err = r.deleteLegacy(ctx, namespacedName.Namespace, "Deployment", legacy)
+		if err != nil {
+			logger.Warnw("Could not delete legacy Deployment", "err", err, "namespacedName", namespacedName)
+		}
+	}
+	_ = r.deleteLegacy(ctx, namespacedName.Namespace, "Secret", legacyPullSecretName(namespacedName))
+	_ = r.deleteLegacy(ctx, namespacedName.Namespace, "Secret", legacyHistorySecretName(namespacedName))
+
+	r.statuses.delete(namespacedName.Namespace, namespacedName.Name)
+	r.pushed.forget(namespacedName.Namespace, namespacedName.Name)
+}
@@ -0,0 +1,146 @@
+package reconciling
+
+import (
+	"context"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func (environment *testEnvironment) reconcile(t *testing.T) {
+	err := environment.reconciler.ReconcileDeployments(context.Background(), testNamespace)
+	if err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+}
+
+func (environment *testEnvironment) deploymentExists(t *testing.T, name string) bool {
+	_, err := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace)).Get(context.Background(), name, metav1.GetOptions{})
+	if apiErrors.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("could not get deployment %s: %v", name, err)
+	}
+	return true
+}
+
+func TestReconcileDeploymentsCreatesResources(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{
+		Image:       "nginx",
+		Replicas:    2,
+		PullSecrets: `{"auths":{}}`,
+		Environment: map[string]string{"MODE": "test"},
+	})
+
+	environment.reconcile(t)
+
+	deployment, err := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace)).Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("service deployment was not created: %v", err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("expected 2 replicas, got %d", *deployment.Spec.Replicas)
+	}
+	if image := deployment.Spec.Template.Spec.Containers[0].Image; image != "nginx" {
+		t.Errorf("expected image nginx, got %s", image)
+	}
+
+	if !environment.deploymentExists(t, serviceLBDeploymentName(name)) {
+		t.Errorf("load balancer deployment was not created")
+	}
+
+	_, err = environment.clientset.CoreV1().Secrets(targetNamespace(testNamespace)).Get(ctx, pullSecretName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("pull secret was not created: %v", err)
+	}
+
+	status, _ := environment.reconciler.statuses.get(testNamespace, "web")
+	if status.Phase == StatusFailed || status.Phase == StatusQuotaExceeded {
+		t.Errorf("unexpected status %s: %s", status.Phase, status.Message)
+	}
+}
+
+func TestReconcileDeploymentsUpdatesResources(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx:1", Replicas: 1})
+	environment.reconcile(t)
+
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx:2", Replicas: 3})
+	environment.reconcile(t)
+
+	deployment, err := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace)).Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get service deployment: %v", err)
+	}
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("expected 3 replicas, got %d", *deployment.Spec.Replicas)
+	}
+	if image := deployment.Spec.Template.Spec.Containers[0].Image; image != "nginx:2" {
+		t.Errorf("expected image nginx:2, got %s", image)
+	}
+
+	history, err := environment.reconciler.revisionHistory(ctx, testNamespace, "web")
+	if err != nil {
+		t.Fatalf("could not get revision history: %v", err)
+	}
+	if len(history) != 2 {
+		t.Errorf("expected 2 revisions, got %d", len(history))
+	}
+}
+
+func TestRollbackKeepsStoredReplicas(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx:1", Replicas: 1})
+	environment.reconcile(t)
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx:2", Replicas: 3})
+	environment.reconcile(t)
+
+	history, err := environment.reconciler.revisionHistory(ctx, testNamespace, "web")
+	if err != nil {
+		t.Fatalf("could not get revision history: %v", err)
+	}
+	err = environment.reconciler.rollback(ctx, testNamespace, "web", history[len(history)-1].Revision)
+	if err != nil {
+		t.Fatalf("could not roll back: %v", err)
+	}
+
+	service, _ := environment.storage.GetService(ctx, testNamespace, "web")
+	if service.Image != "nginx:1" {
+		t.Errorf("expected image nginx:1, got %s", service.Image)
+	}
+	if service.Replicas != 3 {
+		t.Errorf("expected the stored 3 replicas to be kept, got %d", service.Replicas)
+	}
+}
+
+func TestReconcileDeploymentsDeletesRemovedServices(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx", Replicas: 1})
+	_ = environment.storage.SetService(ctx, testNamespace, "api", &protoStorage.Service{Image: "api", Replicas: 1})
+	environment.reconcile(t)
+
+	environment.storage.deleteService(testNamespace, "api")
+	environment.reconcile(t)
+
+	removed := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "api"}
+	if environment.deploymentExists(t, serviceDeploymentName(removed)) {
+		t.Errorf("service deployment of removed service still exists")
+	}
+	if environment.deploymentExists(t, serviceLBDeploymentName(removed)) {
+		t.Errorf("load balancer deployment of removed service still exists")
+	}
+
+	kept := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	if !environment.deploymentExists(t, serviceDeploymentName(kept)) || !environment.deploymentExists(t, serviceLBDeploymentName(kept)) {
+		t.Errorf("deployments of remaining service were deleted")
+	}
+}
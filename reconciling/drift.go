@@ -0,0 +1,188 @@
+package reconciling
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+)
+
+const (
+	managedByAnnotation = labelPrefix + "managed-by"
+	// specHashAnnotation is the hash of the spec the manager applied last, a live spec that differs from it has drifted
+	specHashAnnotation = labelPrefix + "spec-hash"
+	EventAdopted       = "Adopted"
+	EventDriftDetected = "DriftDetected"
+)
+
+var ErrNotAdoptable = errors.New("resource exists and cannot be adopted")
+
+func specHash(spec *appsv1.DeploymentSpec) string {
+	data, _ := json.Marshal(spec)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// setSpecHash records the spec of a deployment the manager is about to write. Every write of the manager that
+// changes a spec sets it, so the informers can tell the manager's own changes from those of someone else.
+func setSpecHash(deployment *appsv1.Deployment) {
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string)
+	}
+	deployment.Annotations[specHashAnnotation] = specHash(&deployment.Spec)
+}
+
+// driftReports remembers the spec hash each drifted deployment had when its drift was reported, so a drift that
+// is kept by the drift policy is reported once and not on every reconcile
+type driftReports struct {
+	mutex  sync.Mutex
+	hashes map[types.NamespacedName]string
+}
+
+func newDriftReports() *driftReports {
+	return &driftReports{hashes: make(map[types.NamespacedName]string)}
+}
+
+// report returns false if the drift of the deployment has already been reported for its spec hash
+func (reports *driftReports) report(deployment *appsv1.Deployment) bool {
+	reports.mutex.Lock()
+	defer reports.mutex.Unlock()
+
+	key := types.NamespacedName{Namespace: deployment.Namespace, Name: deployment.Name}
+	hash := deployment.Annotations[specHashAnnotation]
+	if reported, ok := reports.hashes[key]; ok && reported == hash {
+		return false
+	}
+	reports.hashes[key] = hash
+	return true
+}
+
+// forget lets the next drift of the deployment be reported again
+func (reports *driftReports) forget(deployment *appsv1.Deployment) {
+	reports.mutex.Lock()
+	defer reports.mutex.Unlock()
+	delete(reports.hashes, types.NamespacedName{Namespace: deployment.Namespace, Name: deployment.Name})
+}
+
+// checkAdoptable fails if an existing resource belongs to someone else or to another service
+func checkAdoptable(existing *metav1.ObjectMeta, desired *metav1.ObjectMeta) error {
+	if manager, ok := existing.Annotations[managedByAnnotation]; ok && manager != eventSource {
+		return fmt.Errorf("%w: %s is managed by %s", ErrNotAdoptable, existing.Name, manager)
+	}
+	for _, label := range []string{namespaceLabel, nameLabel, typeLabel} {
+		if value, ok := existing.Labels[label]; ok && value != desired.Labels[label] {
+			return fmt.Errorf("%w: %s belongs to %s %s", ErrNotAdoptable, existing.Name, label, value)
+		}
+	}
+	return nil
+}
+
+// drifted reports whether a live deployment has been changed outside of kuly since it was applied.
+// A changed spec hash means the desired state changed, which is not a drift.
+func drifted(desired *appsv1.Deployment, live *appsv1.Deployment) bool {
+	if live.Annotations[specHashAnnotation] != desired.Annotations[specHashAnnotation] {
+		return false
+	}
+	// defaults added by the API server are not a drift, so only fields the manager sets are compared
+	return !equality.Semantic.DeepDerivative(desired.Spec, live.Spec) || !equality.Semantic.DeepDerivative(desired.Labels, live.Labels)
+}
+
+// applyDeployment creates or updates a deployment. Drift of a deployment whose desired state did not change
+// is handled according to the drift policy.
+func (r *KubernetesReconciler) applyDeployment(ctx context.Context, deployment *appsv1.Deployment, live *appsv1.Deployment) error {
+	deploymentsClient := r.clientset.AppsV1().Deployments(deployment.Namespace)
+	setSpecHash(deployment)
+	if live == nil {
+		return r.createOrAdoptDeployment(ctx, deployment)
+	}
+
+	if drifted(deployment, live) {
+		policy := config.GlobalConfig().DriftPolicy
+		if policy != config.DriftPolicyIgnore && r.drifts.report(live) {
+			message := fmt.Sprintf("Deployment was changed outside of kuly, drift policy is %s", policy)
+			logger.Warnw("detected drift", "deployment", live.Name, "namespace", live.Namespace, "policy", policy)
+			r.recordEvent(ctx, live, corev1.EventTypeWarning, EventDriftDetected, message)
+		}
+		if policy == config.DriftPolicyReport || policy == config.DriftPolicyIgnore {
+			return nil
+		}
+	} else {
+		r.drifts.forget(live)
+	}
+
+	// the update fails with a conflict if the live deployment is outdated, it would revert newer changes otherwise
+	deployment.ResourceVersion = live.ResourceVersion
+	_, err := deploymentsClient.Update(ctx, deployment, metav1.UpdateOptions{})
+	if apiErrors.IsNotFound(err) {
+		return r.createOrAdoptDeployment(ctx, deployment)
+	}
+	return err
+}
+
+// createOrAdoptDeployment creates a deployment or takes over an existing one of the same name that is not managed by anyone else.
+// The selector of a deployment cannot be changed, so only deployments with exactly the selector kuly renders are adopted.
+// Deployments that were created by hand usually select their pods differently, they have to be deleted so kuly can
+// recreate them.
+func (r *KubernetesReconciler) createOrAdoptDeployment(ctx context.Context, deployment *appsv1.Deployment) error {
+	deploymentsClient := r.clientset.AppsV1().Deployments(deployment.Namespace)
+	deployment.ResourceVersion = ""
+	_, err := deploymentsClient.Create(ctx, deployment, metav1.CreateOptions{})
+	if !apiErrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := deploymentsClient.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	err = checkAdoptable(&existing.ObjectMeta, &deployment.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	if !equality.Semantic.DeepEqual(existing.Spec.Selector, deployment.Spec.Selector) {
+		return fmt.Errorf("%w: %s selects its pods with %s instead of %s and a selector cannot be changed, delete the deployment so it can be recreated",
+			ErrNotAdoptable, existing.Name, metav1.FormatLabelSelector(existing.Spec.Selector), metav1.FormatLabelSelector(deployment.Spec.Selector))
+	}
+
+	logger.Infow("adopting Deployment", "deployment", existing.Name, "namespace", existing.Namespace)
+	deployment.ResourceVersion = existing.ResourceVersion
+	updated, err := deploymentsClient.Update(ctx, deployment, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	r.recordEvent(ctx, updated, corev1.EventTypeNormal, EventAdopted, "Existing deployment has been adopted by kuly")
+	return nil
+}
+
+// applySecret creates or updates a secret and adopts an existing one of the same name that is not managed by anyone else
+func (r *KubernetesReconciler) applySecret(ctx context.Context, secret *corev1.Secret) error {
+	secretsClient := r.clientset.CoreV1().Secrets(secret.Namespace)
+	existing, err := secretsClient.Get(ctx, secret.Name, metav1.GetOptions{})
+	if apiErrors.IsNotFound(err) {
+		_, err = secretsClient.Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	err = checkAdoptable(&existing.ObjectMeta, &secret.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	if existing.Annotations[managedByAnnotation] != eventSource {
+		logger.Infow("adopting Secret", "secret", existing.Name, "namespace", existing.Namespace)
+	}
+	_, err = secretsClient.Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
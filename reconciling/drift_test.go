@@ -0,0 +1,142 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+func TestReconcileAdoptsUnlabeledDeployment(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	service := &protoStorage.Service{Image: "nginx", Replicas: 1}
+
+	orphan := buildDeploymentFromService(name, service)
+	orphan.Labels = nil
+	orphan.Annotations = nil
+	_, err := environment.clientset.AppsV1().Deployments(orphan.Namespace).Create(ctx, orphan, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("could not create deployment: %v", err)
+	}
+
+	environment.deployServices(t, "web")
+
+	adopted, err := environment.clientset.AppsV1().Deployments(orphan.Namespace).Get(ctx, orphan.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	if adopted.Labels[nameLabel] != "web" || adopted.Annotations[managedByAnnotation] != eventSource {
+		t.Errorf("deployment was not adopted, labels %v, annotations %v", adopted.Labels, adopted.Annotations)
+	}
+}
+
+func TestReconcileReportsSelectorOfHandMadeDeployment(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx", Replicas: 1})
+
+	// a deployment of the same name as it would be written by hand
+	replicas := int32(1)
+	handMade := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: serviceDeploymentName(name), Namespace: targetNamespace(testNamespace), Labels: map[string]string{"app": "web"}},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+			},
+		},
+	}
+	_, err := environment.clientset.AppsV1().Deployments(handMade.Namespace).Create(ctx, handMade, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("could not create deployment: %v", err)
+	}
+
+	err = environment.reconciler.ReconcileService(ctx, testNamespace, "web")
+	if !errors.Is(err, ErrNotAdoptable) {
+		t.Fatalf("expected a deployment with another selector not to be adopted, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "app=web") || !strings.Contains(err.Error(), "recreated") {
+		t.Errorf("expected the error to name the selector and how to resolve it, got %v", err)
+	}
+
+	existing, err := environment.clientset.AppsV1().Deployments(handMade.Namespace).Get(ctx, handMade.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	if _, ok := existing.Annotations[managedByAnnotation]; ok || existing.Spec.Template.Spec.Containers[0].Name != "web" {
+		t.Errorf("deployment that could not be adopted was changed")
+	}
+}
+
+func TestReconcileDoesNotAdoptForeignDeployment(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	service := &protoStorage.Service{Image: "nginx", Replicas: 1}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", service)
+
+	foreign := buildDeploymentFromService(name, service)
+	foreign.Labels = nil
+	foreign.Annotations = map[string]string{managedByAnnotation: "helm"}
+	_, err := environment.clientset.AppsV1().Deployments(foreign.Namespace).Create(ctx, foreign, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("could not create deployment: %v", err)
+	}
+
+	err = environment.reconciler.ReconcileService(ctx, testNamespace, "web")
+	if !errors.Is(err, ErrNotAdoptable) {
+		t.Errorf("expected a deployment managed by helm not to be adopted, got %v", err)
+	}
+}
+
+func TestDriftPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy   string
+		reverted bool
+	}{
+		{policy: config.DriftPolicyRevert, reverted: true},
+		{policy: config.DriftPolicyReport, reverted: false},
+		{policy: config.DriftPolicyIgnore, reverted: false},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			environment := newTestEnvironment(t, 12270)
+			config.GlobalConfig().DriftPolicy = test.policy
+			ctx := context.Background()
+			environment.deployServices(t, "web")
+
+			deploymentsClient := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace))
+			deploymentName := serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"})
+			deployment, _ := deploymentsClient.Get(ctx, deploymentName, metav1.GetOptions{})
+			deployment.Spec.Template.Spec.Containers[0].Image = "edited-by-hand"
+			_, _ = deploymentsClient.Update(ctx, deployment, metav1.UpdateOptions{})
+
+			// a drift that is kept is reported once and not on every reconcile
+			environment.reconcile(t)
+			environment.reconcile(t)
+
+			deployment, _ = deploymentsClient.Get(ctx, deploymentName, metav1.GetOptions{})
+			reverted := deployment.Spec.Template.Spec.Containers[0].Image == "web"
+			if reverted != test.reverted {
+				t.Errorf("expected reverted to be %v, image is %s", test.reverted, deployment.Spec.Template.Spec.Containers[0].Image)
+			}
+
+			expected := 1
+			if test.policy == config.DriftPolicyIgnore {
+				expected = 0
+			}
+			if reported := environment.recordedEvents(t, EventDriftDetected); reported != expected {
+				t.Errorf("expected %d drift reports with policy %s, got %d", expected, test.policy, reported)
+			}
+		})
+	}
+}
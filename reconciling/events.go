@@ -0,0 +1,47 @@
+package reconciling
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+)
+
+const eventSource = "kuly-service-manager"
+
+// recordEvent creates a kubernetes event for a managed deployment so failures are visible in the cluster as well
+func (r *KubernetesReconciler) recordEvent(ctx context.Context, deployment *appsv1.Deployment, eventType string, reason string, message string) {
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", deployment.Name, now.UnixNano()),
+			Namespace: deployment.Namespace,
+			Labels: map[string]string{
+				namespaceLabel: deployment.Labels[namespaceLabel],
+				nameLabel:      deployment.Labels[nameLabel],
+			},
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "apps/v1",
+			Kind:            "Deployment",
+			Name:            deployment.Name,
+			Namespace:       deployment.Namespace,
+			UID:             deployment.UID,
+			ResourceVersion: deployment.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: eventSource},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err := r.clientset.CoreV1().Events(deployment.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		logger.Warnw("Could not create Event", "err", err, "deployment", deployment.Name, "reason", reason)
+	}
+}
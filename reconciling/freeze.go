@@ -0,0 +1,146 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	protoCommon "github.com/kulycloud/protocol/common"
+	"sync"
+	"time"
+)
+
+var ErrStorageRead = errors.New("could not read from storage")
+
+// freezeState tracks whether the manager is frozen because storage is unavailable.
+// While frozen the load balancers are served the endpoints they were sent last, see pushedEndpoints.
+type freezeState struct {
+	mutex  sync.Mutex
+	frozen bool
+	since  time.Time
+}
+
+func newFreezeState() *freezeState {
+	return &freezeState{}
+}
+
+// freeze returns true if the manager was not frozen before
+func (state *freezeState) freeze() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.frozen {
+		return false
+	}
+	state.frozen = true
+	state.since = time.Now()
+	return true
+}
+
+// thaw returns how long the manager has been frozen and false if it was not frozen
+func (state *freezeState) thaw() (time.Duration, bool) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if !state.frozen {
+		return 0, false
+	}
+	state.frozen = false
+	return time.Since(state.since), true
+}
+
+func (state *freezeState) isFrozen() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.frozen
+}
+
+// endpointSet is what the load balancers of a service were sent
+type endpointSet struct {
+	services []*protoCommon.Endpoint
+	storage  []*protoCommon.Endpoint
+}
+
+// pushedEndpoints remembers the endpoints that were pushed to the load balancers of each service last,
+// so they can be served while frozen
+type pushedEndpoints struct {
+	mutex sync.Mutex
+	sets  map[string]*endpointSet
+}
+
+func newPushedEndpoints() *pushedEndpoints {
+	return &pushedEndpoints{sets: make(map[string]*endpointSet)}
+}
+
+func (pushed *pushedEndpoints) set(namespace string, service string, set *endpointSet) {
+	pushed.mutex.Lock()
+	defer pushed.mutex.Unlock()
+	pushed.sets[statusKey(namespace, service)] = set
+}
+
+func (pushed *pushedEndpoints) get(namespace string, service string) (*endpointSet, bool) {
+	pushed.mutex.Lock()
+	defer pushed.mutex.Unlock()
+	set, ok := pushed.sets[statusKey(namespace, service)]
+	return set, ok
+}
+
+func (pushed *pushedEndpoints) forget(namespace string, service string) {
+	pushed.mutex.Lock()
+	defer pushed.mutex.Unlock()
+	delete(pushed.sets, statusKey(namespace, service))
+}
+
+// frozenEndpoints returns the service endpoints that were pushed last without the ones whose pods are gone.
+// If none of them is left the current endpoints are used, the load balancers would have nothing to serve otherwise.
+func frozenEndpoints(last []*protoCommon.Endpoint, current []*protoCommon.Endpoint) []*protoCommon.Endpoint {
+	running := make(map[string]bool, len(current))
+	for _, endpoint := range current {
+		running[fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)] = true
+	}
+
+	endpoints := make([]*protoCommon.Endpoint, 0, len(last))
+	for _, endpoint := range last {
+		if running[fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)] {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return current
+	}
+	return endpoints
+}
+
+// Freeze stops all updates of the load balancers until Thaw is called
+func (r *KubernetesReconciler) Freeze(reason string) {
+	if r.freeze.freeze() {
+		logger.Warnw("freezing load balancer endpoints while storage is unavailable", "reason", reason, "cluster", r.cluster)
+	}
+}
+
+// Thaw ends the frozen mode and pushes the current storage and service endpoints to all load balancers.
+// Nothing is pushed if the manager was not frozen.
+func (r *KubernetesReconciler) Thaw(ctx context.Context) error {
+	if !r.thaw() {
+		return nil
+	}
+	return r.resyncLoadBalancers(ctx)
+}
+
+// thaw ends the frozen mode and returns false if the manager was not frozen
+func (r *KubernetesReconciler) thaw() bool {
+	duration, ok := r.freeze.thaw()
+	if ok {
+		logger.Infow("storage is available again, resyncing load balancers", "frozenFor", duration, "cluster", r.cluster)
+	}
+	return ok
+}
+
+// resyncLoadBalancers pushes the current storage and service endpoints to all load balancers
+func (r *KubernetesReconciler) resyncLoadBalancers(ctx context.Context) error {
+	r.PropagateStorageToLoadBalancers(ctx, r.storage.StorageEndpoints())
+	return r.ResyncLoadBalancers(ctx, "")
+}
+
+func (r *KubernetesReconciler) Frozen() bool {
+	return r.freeze.isFrozen()
+}
@@ -0,0 +1,132 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+// flakyStorage fails to read the services in broken
+type flakyStorage struct {
+	*memoryStorage
+	broken map[string]bool
+}
+
+func (storage *flakyStorage) GetService(ctx context.Context, namespace string, name string) (*protoStorage.Service, error) {
+	if storage.broken[name] {
+		return nil, fmt.Errorf("connection reset")
+	}
+	return storage.memoryStorage.GetService(ctx, namespace, name)
+}
+
+func TestReconcileDeploymentsIsAllOrNothingOnStorageErrors(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	environment.deployServices(t, "web", "api")
+
+	storage := &flakyStorage{memoryStorage: environment.storage, broken: map[string]bool{"web": true}}
+	environment.reconciler.storage = storage
+	environment.storage.deleteService(testNamespace, "api")
+	_ = environment.storage.SetService(context.Background(), testNamespace, "new", &protoStorage.Service{Image: "new", Replicas: 1})
+
+	err := environment.reconciler.ReconcileDeployments(context.Background(), testNamespace)
+	if !errors.Is(err, ErrStorageRead) {
+		t.Fatalf("expected a storage read error, got %v", err)
+	}
+	if !environment.reconciler.Frozen() {
+		t.Errorf("expected the reconciler to freeze on storage errors")
+	}
+	if !environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "api"})) {
+		t.Errorf("service was deleted although storage could not be read")
+	}
+	if environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "new"})) {
+		t.Errorf("service was created although storage could not be read")
+	}
+}
+
+func TestFrozenReconcilerServesRunningPodsWithoutLastEndpoints(t *testing.T) {
+	lb, lbPort := startFakeLoadBalancer(t)
+	environment := newTestEnvironment(t, lbPort)
+	environment.storage.endpoints = testEndpoints("storage", 1)
+	environment.deployServices(t, "web")
+	environment.addPod(t, "lb-1", typeLabelLB, "web", "127.0.0.1", true)
+	environment.addPod(t, "web-1", typeLabelService, "web", "10.0.0.1", true)
+
+	// nothing has been pushed to the load balancer before, e.g. after a restart of the manager
+	environment.reconciler.Freeze("storage is not ready")
+	err := environment.reconciler.ReconcilePods(context.Background(), testNamespace, "web")
+	if err != nil {
+		t.Fatalf("could not reconcile pods: %v", err)
+	}
+	endpoints, storageEndpoints := lb.received()
+	if len(endpoints) != 1 || len(storageEndpoints) != 1 {
+		t.Errorf("expected the running pods and the storage endpoints while frozen, got %v and %v", endpoints, storageEndpoints)
+	}
+
+	environment.addPod(t, "web-2", typeLabelService, "web", "10.0.0.2", true)
+	err = environment.reconciler.Thaw(context.Background())
+	if err != nil {
+		t.Fatalf("could not thaw: %v", err)
+	}
+	if endpoints, _ := lb.received(); len(endpoints) != 2 {
+		t.Errorf("expected the load balancer to be resynced after thawing, got %v", endpoints)
+	}
+
+	environment.addPod(t, "web-3", typeLabelService, "web", "10.0.0.3", true)
+	err = environment.reconciler.Thaw(context.Background())
+	if err != nil {
+		t.Fatalf("could not thaw: %v", err)
+	}
+	if endpoints, _ := lb.received(); len(endpoints) != 2 {
+		t.Errorf("expected no resync without being frozen, got %v", endpoints)
+	}
+}
+
+func TestRestartedLoadBalancerGetsLastEndpointsWhileFrozen(t *testing.T) {
+	lb, lbPort := startFakeLoadBalancer(t)
+	environment := newTestEnvironment(t, lbPort)
+	ctx := context.Background()
+	environment.storage.endpoints = testEndpoints("storage", 1)
+	environment.deployServices(t, "web")
+	environment.addPod(t, "lb-1", typeLabelLB, "web", "127.0.0.1", true)
+	environment.addPod(t, "web-1", typeLabelService, "web", "10.0.0.1", true)
+	environment.addPod(t, "web-2", typeLabelService, "web", "10.0.0.2", true)
+
+	err := environment.reconciler.ReconcilePods(ctx, testNamespace, "web")
+	if err != nil {
+		t.Fatalf("could not reconcile pods: %v", err)
+	}
+	if endpoints, _ := lb.received(); len(endpoints) != 2 {
+		t.Fatalf("expected both service endpoints, got %v", endpoints)
+	}
+
+	// while frozen the load balancer pod restarts with a new IP, one service pod dies and another one starts
+	environment.reconciler.Freeze("storage is not ready")
+	environment.storage.endpoints = nil
+	podsClient := environment.clientset.CoreV1().Pods(targetNamespace(testNamespace))
+	for _, pod := range []string{"lb-1", "web-2"} {
+		err = podsClient.Delete(ctx, pod, metav1.DeleteOptions{})
+		if err != nil {
+			t.Fatalf("could not delete pod %s: %v", pod, err)
+		}
+	}
+	restarted, _ := startFakeLoadBalancerOn(t, fmt.Sprintf("127.0.0.2:%d", lbPort))
+	environment.addPod(t, "lb-2", typeLabelLB, "web", "127.0.0.2", true)
+	environment.addPod(t, "web-3", typeLabelService, "web", "10.0.0.3", true)
+
+	err = environment.reconciler.ReconcilePods(ctx, testNamespace, "web")
+	if err != nil {
+		t.Fatalf("could not reconcile pods while frozen: %v", err)
+	}
+	endpoints, storageEndpoints := restarted.received()
+	expected := []string{fmt.Sprintf("10.0.0.1:%d", testHTTPPort)}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("expected the restarted load balancer to get the last endpoints without dead pods %v, got %v", expected, endpoints)
+	}
+	if len(storageEndpoints) != 1 {
+		t.Errorf("expected the restarted load balancer to get the last storage endpoints, got %v", storageEndpoints)
+	}
+}
@@ -0,0 +1,227 @@
+package reconciling
+
+import (
+	"context"
+	"fmt"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoLoadBalancer "github.com/kulycloud/protocol/load-balancer"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+)
+
+const (
+	testNamespace = "test"
+	testHTTPPort  = 30000
+)
+
+// memoryStorage is an in-memory stand-in for the kuly storage
+type memoryStorage struct {
+	mutex       sync.Mutex
+	services    map[string]map[string]*protoStorage.Service
+	lbEndpoints map[string][]*protoCommon.Endpoint
+	endpoints   []*protoCommon.Endpoint
+}
+
+var _ Storage = &memoryStorage{}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		services:    make(map[string]map[string]*protoStorage.Service),
+		lbEndpoints: make(map[string][]*protoCommon.Endpoint),
+	}
+}
+
+func (storage *memoryStorage) GetServicesInNamespace(ctx context.Context, namespace string) ([]string, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	names := make([]string, 0)
+	for name := range storage.services[namespace] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (storage *memoryStorage) GetService(ctx context.Context, namespace string, name string) (*protoStorage.Service, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	service, ok := storage.services[namespace][name]
+	if !ok {
+		return nil, fmt.Errorf("service %s/%s not found", namespace, name)
+	}
+	return service, nil
+}
+
+func (storage *memoryStorage) SetService(ctx context.Context, namespace string, name string, service *protoStorage.Service) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.services[namespace] == nil {
+		storage.services[namespace] = make(map[string]*protoStorage.Service)
+	}
+	storage.services[namespace][name] = service
+	return nil
+}
+
+func (storage *memoryStorage) deleteService(namespace string, name string) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.services[namespace], name)
+}
+
+func (storage *memoryStorage) SetServiceLBEndpoints(ctx context.Context, namespace string, name string, endpoints []*protoCommon.Endpoint) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.lbEndpoints[statusKey(namespace, name)] = endpoints
+	return nil
+}
+
+func (storage *memoryStorage) StorageEndpoints() []*protoCommon.Endpoint {
+	return storage.endpoints
+}
+
+// fakeLoadBalancer records the endpoint lists it receives over gRPC
+type fakeLoadBalancer struct {
+	protoLoadBalancer.UnimplementedLoadBalancerServer
+	mutex            sync.Mutex
+	endpoints        []*protoCommon.Endpoint
+	storageEndpoints []*protoCommon.Endpoint
+}
+
+func (lb *fakeLoadBalancer) SetStorageEndpoints(ctx context.Context, endpoints *protoCommon.EndpointList) (*protoCommon.Empty, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.storageEndpoints = endpoints.Endpoints
+	return &protoCommon.Empty{}, nil
+}
+
+func (lb *fakeLoadBalancer) SetEndpoints(ctx context.Context, endpoints *protoCommon.EndpointList) (*protoCommon.Empty, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.endpoints = endpoints.Endpoints
+	return &protoCommon.Empty{}, nil
+}
+
+func (lb *fakeLoadBalancer) received() ([]string, []string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return endpointStrings(lb.endpoints), endpointStrings(lb.storageEndpoints)
+}
+
+// startFakeLoadBalancer serves a fake load balancer on localhost and returns its port
+func startFakeLoadBalancer(t *testing.T) (*fakeLoadBalancer, uint32) {
+	return startFakeLoadBalancerOn(t, "127.0.0.1:0")
+}
+
+// startFakeLoadBalancerOn serves a fake load balancer on the given address, e.g. for a second load balancer pod
+// with its own IP on the same port
+func startFakeLoadBalancerOn(t *testing.T, address string) (*fakeLoadBalancer, uint32) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	lb := &fakeLoadBalancer{}
+	server := grpc.NewServer()
+	protoLoadBalancer.RegisterLoadBalancerServer(server, lb)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return lb, uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+type testEnvironment struct {
+	reconciler *KubernetesReconciler
+	clientset  *fake.Clientset
+	storage    *memoryStorage
+}
+
+// newTestEnvironment creates a reconciler on a fake cluster in shared namespace mode.
+// Load balancers are expected to listen on lbPort.
+func newTestEnvironment(t *testing.T, lbPort uint32) *testEnvironment {
+	previousConfig, previousPolicies := config.GlobalConfig(), config.GlobalPolicies()
+	t.Cleanup(func() {
+		config.SetGlobal(previousConfig, previousPolicies)
+	})
+
+	config.SetGlobal(&config.Config{
+		ServiceNamespace:        "kuly-services",
+		NamespaceMode:           config.NamespaceModeShared,
+		LoadBalancerImage:       "kuly/loadbalancer",
+		LoadBalancerControlPort: lbPort,
+		HTTPPort:                testHTTPPort,
+		RevisionHistoryLimit:    10,
+		DriftPolicy:             config.DriftPolicyRevert,
+	}, &config.Policies{})
+
+	environment := &testEnvironment{
+		clientset: fake.NewSimpleClientset(),
+		storage:   newMemoryStorage(),
+	}
+	environment.reconciler = NewKubernetesReconcilerWithClient(environment.storage, environment.clientset, "")
+	return environment
+}
+
+// addPod creates a running pod of a service in the fake cluster
+func (environment *testEnvironment) addPod(t *testing.T, name string, typeName string, service string, ip string, ready bool) {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: targetNamespace(testNamespace),
+			Labels: map[string]string{
+				namespaceLabel: testNamespace,
+				typeLabel:      typeName,
+				nameLabel:      service,
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      ip,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+
+	_, err := environment.clientset.CoreV1().Pods(pod.Namespace).Create(context.Background(), pod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("could not create pod: %v", err)
+	}
+}
+
+// recordedEvents counts the kubernetes events of the test namespace with the given reason
+func (environment *testEnvironment) recordedEvents(t *testing.T, reason string) int {
+	events, err := environment.clientset.CoreV1().Events(targetNamespace(testNamespace)).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("could not list events: %v", err)
+	}
+	count := 0
+	for _, event := range events.Items {
+		if event.Reason == reason {
+			count++
+		}
+	}
+	return count
+}
+
+func endpointStrings(endpoints []*protoCommon.Endpoint) []string {
+	strings := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		strings = append(strings, fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port))
+	}
+	sort.Strings(strings)
+	return strings
+}
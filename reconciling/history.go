@@ -0,0 +1,166 @@
+package reconciling
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"google.golang.org/protobuf/encoding/protojson"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"time"
+)
+
+const (
+	TriggerRollback = "rollback"
+	historyDataKey  = "history"
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is a service definition that has been deployed before
+type Revision struct {
+	Revision        string          `json:"revision"`
+	Image           string          `json:"image"`
+	Arguments       []string        `json:"arguments,omitempty"`
+	EnvironmentHash string          `json:"environmentHash"`
+	Timestamp       time.Time       `json:"timestamp"`
+	Trigger         string          `json:"trigger"`
+	Service         json.RawMessage `json:"service"`
+}
+
+type triggerKey struct{}
+
+// WithTrigger records what caused a reconcile so it can be stored in the revision history
+func WithTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+func triggerFromContext(ctx context.Context) string {
+	trigger, ok := ctx.Value(triggerKey{}).(string)
+	if !ok {
+		return "unknown"
+	}
+	return trigger
+}
+
+func environmentHash(environment map[string]string) string {
+	names := make([]string, 0, len(environment))
+	for name := range environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(hash, "%q=%q\n", name, environment[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// revisionHistory returns the deployed revisions of a service, newest first
+func (r *KubernetesReconciler) revisionHistory(ctx context.Context, namespace string, name string) ([]*Revision, error) {
+	namespacedName := &protoStorage.NamespacedName{Namespace: namespace, Name: name}
+	secret, err := r.clientset.CoreV1().Secrets(targetNamespace(namespace)).Get(ctx, historySecretName(namespacedName), metav1.GetOptions{})
+	if err != nil {
+		if apiErrors.IsNotFound(err) {
+			return []*Revision{}, nil
+		}
+		return nil, err
+	}
+
+	history := make([]*Revision, 0)
+	err = json.Unmarshal(secret.Data[historyDataKey], &history)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse revision history: %w", err)
+	}
+	return history, nil
+}
+
+// recordRevision adds the service to its revision history unless it is already the latest revision
+func (r *KubernetesReconciler) recordRevision(ctx context.Context, name *protoStorage.NamespacedName, service *protoStorage.Service) error {
+	history, err := r.revisionHistory(ctx, name.Namespace, name.Name)
+	if err != nil {
+		return err
+	}
+
+	revision := serviceRevision(service)
+	if len(history) > 0 && history[0].Revision == revision {
+		return nil
+	}
+
+	serialized, err := protojson.Marshal(service)
+	if err != nil {
+		return fmt.Errorf("could not serialize service: %w", err)
+	}
+
+	history = append([]*Revision{{
+		Revision:        revision,
+		Image:           service.Image,
+		Arguments:       service.Arguments,
+		EnvironmentHash: environmentHash(service.Environment),
+		Timestamp:       time.Now().UTC(),
+		Trigger:         triggerFromContext(ctx),
+		Service:         serialized,
+	}}, history...)
+	if limit := int(config.GlobalConfig().RevisionHistoryLimit); len(history) > limit {
+		history = history[:limit]
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("could not serialize revision history: %w", err)
+	}
+
+	secretsClient := r.clientset.CoreV1().Secrets(targetNamespace(name.Namespace))
+	secret := buildHistorySecret(name, data)
+	_, err = secretsClient.Update(ctx, secret, metav1.UpdateOptions{})
+	if apiErrors.IsNotFound(err) {
+		_, err = secretsClient.Create(ctx, secret, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("could not update/create revision history: %w", err)
+	}
+	return nil
+}
+
+// rollback writes a previous revision of a service back to storage and deploys it.
+// The replicas currently stored are kept, a revision only restores what has been deployed.
+func (r *KubernetesReconciler) rollback(ctx context.Context, namespace string, name string, revision string) error {
+	history, err := r.revisionHistory(ctx, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range history {
+		if entry.Revision != revision {
+			continue
+		}
+
+		service := &protoStorage.Service{}
+		err = protojson.Unmarshal(entry.Service, service)
+		if err != nil {
+			return fmt.Errorf("could not parse revision %s: %w", revision, err)
+		}
+
+		current, err := r.storage.GetService(ctx, namespace, name)
+		if err != nil {
+			return r.storageFailed(fmt.Errorf("%w: service %s/%s: %v", ErrStorageRead, namespace, name, err))
+		}
+		service.Replicas = current.Replicas
+
+		logger.Infow("rolling back service", "namespace", namespace, "name", name, "revision", revision)
+		err = r.storage.SetService(ctx, namespace, name, service)
+		if err != nil {
+			return err
+		}
+		return r.ReconcileDeployments(WithTrigger(ctx, TriggerRollback), namespace)
+	}
+
+	return fmt.Errorf("%w: %s", ErrRevisionNotFound, revision)
+}
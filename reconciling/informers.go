@@ -0,0 +1,313 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsv1Listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+)
+
+const maxServiceRequeues = 5
+
+// clusterCache holds the shared informers for all resources the manager owns.
+// Only resources carrying the type label are watched.
+type clusterCache struct {
+	factory     informers.SharedInformerFactory
+	deployments appsv1Listers.DeploymentLister
+	// queue holds the services that have to be reconciled because one of their resources changed,
+	// an empty name stands for all services of a namespace
+	queue  workqueue.RateLimitingInterface
+	mutex  sync.Mutex
+	synced bool
+}
+
+func newClusterCache(clientset kubernetes.Interface) *clusterCache {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(watchedNamespace()),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = typeLabel
+		}),
+	)
+
+	return &clusterCache{
+		factory:     factory,
+		deployments: factory.Apps().V1().Deployments().Lister(),
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+}
+
+func (c *clusterCache) isSynced() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.synced
+}
+
+// start runs the informers and returns once their caches are filled
+func (c *clusterCache) start(ctx context.Context) error {
+	c.factory.Start(ctx.Done())
+	for informerType, synced := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("could not sync cache of %s", informerType)
+		}
+	}
+
+	c.mutex.Lock()
+	c.synced = true
+	c.mutex.Unlock()
+	return nil
+}
+
+// listDeployments lists the deployments of a namespace from the cache. Until the cache is synced the API is asked instead.
+func (r *KubernetesReconciler) listDeployments(ctx context.Context, namespace string, selector string) ([]*appsv1.Deployment, error) {
+	if !r.cache.isSynced() {
+		deployments, err := r.clientset.AppsV1().Deployments(targetNamespace(namespace)).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		items := make([]*appsv1.Deployment, 0, len(deployments.Items))
+		for i := range deployments.Items {
+			items = append(items, &deployments.Items[i])
+		}
+		return items, nil
+	}
+
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := r.cache.deployments.Deployments(targetNamespace(namespace)).List(parsed)
+	if err != nil {
+		return nil, err
+	}
+	// cached objects are shared with the informer and must not be changed
+	items := make([]*appsv1.Deployment, 0, len(cached))
+	for _, deployment := range cached {
+		items = append(items, deployment.DeepCopy())
+	}
+	return items, nil
+}
+
+// getDeployment gets a deployment from the cache, or from the API until the cache is synced.
+// A deployment that was just created may be missing from the cache, so the API is asked as well if it is not found.
+// The returned deployment must not be changed.
+func (r *KubernetesReconciler) getDeployment(ctx context.Context, namespace string, name string) (*appsv1.Deployment, error) {
+	if r.cache.isSynced() {
+		deployment, err := r.cache.deployments.Deployments(targetNamespace(namespace)).Get(name)
+		if !apiErrors.IsNotFound(err) {
+			return deployment, err
+		}
+	}
+	return r.clientset.AppsV1().Deployments(targetNamespace(namespace)).Get(ctx, name, metav1.GetOptions{})
+}
+
+// liveDeployment returns the listed deployment of a service or gets it if it has not been listed.
+// A stale cache would otherwise make an existing deployment look new and lose its rollout state.
+func (r *KubernetesReconciler) liveDeployment(ctx context.Context, name *protoStorage.NamespacedName, listed *appsv1.Deployment) (*appsv1.Deployment, error) {
+	if listed != nil {
+		return listed, nil
+	}
+
+	deployment, err := r.getDeployment(ctx, name.Namespace, serviceDeploymentName(name))
+	if apiErrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// deployments that are not managed by kuly yet are adopted or refused when they are created
+	ownerNamespace, ownerName := owner(deployment)
+	if deployment.Annotations[managedByAnnotation] != eventSource || deployment.Labels[typeLabel] != typeLabelService ||
+		ownerNamespace != name.Namespace || ownerName != name.Name {
+		return nil, nil
+	}
+	return deployment.DeepCopy(), nil
+}
+
+// enqueueOwner queues a reconcile of the service a resource belongs to
+func (r *KubernetesReconciler) enqueueOwner(meta metav1.Object) {
+	namespace, name := owner(meta)
+	if namespace == "" || name == "" {
+		return
+	}
+	r.cache.queue.Add(types.NamespacedName{Namespace: namespace, Name: name})
+}
+
+// enqueueNamespace queues a reconcile of all services of the kuly namespace a resource belongs to
+func (r *KubernetesReconciler) enqueueNamespace(meta metav1.Object) {
+	namespace, _ := owner(meta)
+	if namespace == "" {
+		return
+	}
+	r.cache.queue.Add(types.NamespacedName{Namespace: namespace})
+}
+
+// deploymentHandlers enqueue a reconcile when a deployment is deleted or its spec is changed by someone else.
+// Writes of the manager itself change the spec hash and are skipped.
+func (r *KubernetesReconciler) deploymentHandlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldDeployment, ok := oldObj.(*appsv1.Deployment)
+			if !ok {
+				return
+			}
+			newDeployment, ok := newObj.(*appsv1.Deployment)
+			if !ok {
+				logger.Warnw("could not cast")
+				return
+			}
+			if oldDeployment.Generation == newDeployment.Generation || oldDeployment.Annotations[specHashAnnotation] != newDeployment.Annotations[specHashAnnotation] {
+				return
+			}
+			r.enqueueOwner(newDeployment)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			deployment, ok := obj.(*appsv1.Deployment)
+			if !ok {
+				logger.Warnw("could not cast")
+				return
+			}
+			r.enqueueOwner(deployment)
+		},
+	}
+}
+
+// secretHandlers enqueue a reconcile when a pull secret is deleted or its data is changed
+func (r *KubernetesReconciler) secretHandlers() cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			secret, ok := obj.(*corev1.Secret)
+			return ok && secret.Labels[typeLabel] == typeLabelPullSecret
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldSecret := oldObj.(*corev1.Secret)
+				newSecret := newObj.(*corev1.Secret)
+				if !equality.Semantic.DeepEqual(oldSecret.Data, newSecret.Data) {
+					r.enqueueOwner(newSecret)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				r.enqueueOwner(obj.(*corev1.Secret))
+			},
+		},
+	}
+}
+
+// namespaceHandlers enqueue a reconcile of a kuly namespace when its kubernetes namespace is deleted
+func (r *KubernetesReconciler) namespaceHandlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			namespace, ok := obj.(*corev1.Namespace)
+			if !ok {
+				logger.Warnw("could not cast")
+				return
+			}
+			r.enqueueNamespace(namespace)
+		},
+	}
+}
+
+// quotaHandlers enqueue a reconcile of a kuly namespace when its ResourceQuota or LimitRange is deleted or its
+// spec is changed
+func (r *KubernetesReconciler) quotaHandlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			switch newQuota := newObj.(type) {
+			case *corev1.ResourceQuota:
+				oldQuota, ok := oldObj.(*corev1.ResourceQuota)
+				if ok && !equality.Semantic.DeepEqual(oldQuota.Spec, newQuota.Spec) {
+					r.enqueueNamespace(newQuota)
+				}
+			case *corev1.LimitRange:
+				oldLimitRange, ok := oldObj.(*corev1.LimitRange)
+				if ok && !equality.Semantic.DeepEqual(oldLimitRange.Spec, newQuota.Spec) {
+					r.enqueueNamespace(newQuota)
+				}
+			default:
+				logger.Warnw("could not cast")
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			meta, ok := obj.(metav1.Object)
+			if !ok {
+				logger.Warnw("could not cast")
+				return
+			}
+			r.enqueueNamespace(meta)
+		},
+	}
+}
+
+// processQueue reconciles the queued services until the context is done
+func (r *KubernetesReconciler) processQueue(ctx context.Context) {
+	for r.processNextService(ctx) {
+	}
+}
+
+func (r *KubernetesReconciler) processNextService(ctx context.Context) bool {
+	item, shutdown := r.cache.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.cache.queue.Done(item)
+
+	key := item.(types.NamespacedName)
+	namespace, name := key.Namespace, key.Name
+
+	var err error
+	if name == "" {
+		// resources of the whole namespace changed
+		logger.Infow("reconciling namespace",
+			"trigger", TriggerEvent,
+			"namespace", namespace)
+		err = r.ReconcileDeployments(WithTrigger(ctx, TriggerEvent), namespace)
+	} else {
+		logger.Infow("reconciling service",
+			"trigger", TriggerEvent,
+			"namespace", namespace,
+			"name", name)
+		err = r.ReconcileService(WithTrigger(ctx, TriggerEvent), namespace, name)
+	}
+	if err == nil {
+		r.cache.queue.Forget(item)
+		return true
+	}
+
+	logger.Warnw("error reconciling service", "namespace", namespace, "name", name, "error", err)
+	// storage errors are left to the scheduler which reconciles everything once storage is back,
+	// blocked deletions wait for their confirmation
+	if !errors.Is(err, ErrStorageRead) && !errors.Is(err, ErrDeletionBlocked) && r.cache.queue.NumRequeues(item) < maxServiceRequeues {
+		r.cache.queue.AddRateLimited(item)
+	} else {
+		r.cache.queue.Forget(item)
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+package reconciling
+
+import (
+	"context"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sTesting "k8s.io/client-go/testing"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// monitor runs the informers of the reconciler until the test ends
+func (environment *testEnvironment) monitor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		err := environment.reconciler.MonitorCluster(ctx)
+		if err != nil {
+			t.Errorf("could not monitor cluster: %v", err)
+		}
+	}()
+
+	for !environment.reconciler.cache.isSynced() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (environment *testEnvironment) waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeletedResourcesAreRepaired(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx", Replicas: 1, PullSecrets: `{"auths":{}}`})
+	environment.reconcile(t)
+	environment.monitor(t)
+
+	err := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace)).Delete(ctx, serviceLBDeploymentName(name), metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("could not delete load balancer: %v", err)
+	}
+	environment.waitFor(t, "the load balancer to be recreated", func() bool {
+		return environment.deploymentExists(t, serviceLBDeploymentName(name))
+	})
+
+	secretsClient := environment.clientset.CoreV1().Secrets(targetNamespace(testNamespace))
+	err = secretsClient.Delete(ctx, pullSecretName(name), metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("could not delete pull secret: %v", err)
+	}
+	environment.waitFor(t, "the pull secret to be recreated", func() bool {
+		_, err := secretsClient.Get(ctx, pullSecretName(name), metav1.GetOptions{})
+		return err == nil
+	})
+}
+
+func TestReconcileDeploymentsListsFromCache(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	environment.deployServices(t, "web", "api")
+	environment.monitor(t)
+
+	deployments, err := environment.reconciler.listDeployments(context.Background(), testNamespace, typeLabel+"="+typeLabelService)
+	if err != nil {
+		t.Fatalf("could not list deployments: %v", err)
+	}
+	if len(deployments) != 2 {
+		t.Errorf("expected 2 service deployments in the cache, got %d", len(deployments))
+	}
+
+	environment.storage.deleteService(testNamespace, "api")
+	environment.reconcile(t)
+	if environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "api"})) {
+		t.Errorf("deployment of removed service was not deleted")
+	}
+}
+
+func TestStaleCacheKeepsDeploymentState(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	deploymentsClient := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace))
+	environment.deployServices(t, "web")
+	deployment, err := deploymentsClient.Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	err = environment.reconciler.markRevision(ctx, deployment, goodRevisionAnnotation, deployment.Annotations[revisionAnnotation])
+	if err != nil {
+		t.Fatalf("could not mark revision: %v", err)
+	}
+
+	// the cache counts as synced but has not seen the deployment yet
+	environment.reconciler.cache.synced = true
+	environment.reconcile(t)
+
+	deployment, err = deploymentsClient.Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	if _, ok := deployment.Annotations[goodRevisionAnnotation]; !ok {
+		t.Errorf("finished rollout of the service was lost")
+	}
+	if environment.recordedEvents(t, EventAdopted) > 0 {
+		t.Errorf("own deployment was reported as adopted")
+	}
+}
+
+func TestOwnDeploymentChangesAreNotQueued(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(environment *testEnvironment) error
+		queued bool
+	}{
+		{name: "promotion", change: func(environment *testEnvironment) error {
+			name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+			canary := buildCanaryDeploymentFromService(name, &protoStorage.Service{Image: "web:2", Replicas: 1}, 1)
+			canary, err := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace)).Create(context.Background(), canary, metav1.CreateOptions{})
+			if err != nil {
+				return err
+			}
+			return environment.reconciler.promoteCanary(context.Background(), name, canary)
+		}},
+		{name: "edit", queued: true, change: func(environment *testEnvironment) error {
+			deploymentsClient := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace))
+			deployment, err := deploymentsClient.Get(context.Background(), serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			deployment.Spec.Template.Spec.Containers[0].Image = "edited-by-hand"
+			_, err = deploymentsClient.Update(context.Background(), deployment, metav1.UpdateOptions{})
+			return err
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			environment := newTestEnvironment(t, 12270)
+			ctx := context.Background()
+			environment.deployServices(t, "web")
+			deploymentsClient := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace))
+			deploymentName := serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"})
+			before, _ := deploymentsClient.Get(ctx, deploymentName, metav1.GetOptions{})
+
+			err := test.change(environment)
+			if err != nil {
+				t.Fatalf("could not change deployment: %v", err)
+			}
+			after, _ := deploymentsClient.Get(ctx, deploymentName, metav1.GetOptions{})
+			// the fake clientset does not bump the generation of a changed spec
+			after.Generation = before.Generation + 1
+
+			environment.reconciler.deploymentHandlers().OnUpdate(before, after)
+			if queued := environment.reconciler.cache.queue.Len() > 0; queued != test.queued {
+				t.Errorf("expected queued to be %v", test.queued)
+			}
+		})
+	}
+}
+
+// versionDeployments makes the fake cluster version deployments and refuse updates of outdated ones like a real
+// API server does. Updates without a resource version are unconditional.
+func (environment *testEnvironment) versionDeployments() {
+	version := 0
+	environment.clientset.PrependReactor("create", "deployments", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		version++
+		action.(k8sTesting.CreateAction).GetObject().(*appsv1.Deployment).ResourceVersion = strconv.Itoa(version)
+		return false, nil, nil
+	})
+	environment.clientset.PrependReactor("update", "deployments", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		deployment := action.(k8sTesting.UpdateAction).GetObject().(*appsv1.Deployment)
+		existing, err := environment.clientset.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), deployment.Namespace, deployment.Name)
+		if err != nil {
+			return false, nil, nil
+		}
+		if deployment.ResourceVersion != "" && deployment.ResourceVersion != existing.(*appsv1.Deployment).ResourceVersion {
+			return true, nil, apiErrors.NewConflict(appsv1.Resource("deployments"), deployment.Name, nil)
+		}
+		version++
+		deployment.ResourceVersion = strconv.Itoa(version)
+		return false, nil, nil
+	})
+}
+
+func TestStaleCacheDoesNotRevertNewerChanges(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	environment.versionDeployments()
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	deploymentsClient := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace))
+	environment.deployServices(t, "web")
+
+	// the cache still holds the deployment as it was before the rollout finished
+	deployment, err := deploymentsClient.Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	err = environment.reconciler.cache.factory.Apps().V1().Deployments().Informer().GetIndexer().Add(deployment.DeepCopy())
+	if err != nil {
+		t.Fatalf("could not fill cache: %v", err)
+	}
+	environment.reconciler.cache.synced = true
+	err = environment.reconciler.markRevision(ctx, deployment, goodRevisionAnnotation, deployment.Annotations[revisionAnnotation])
+	if err != nil {
+		t.Fatalf("could not mark revision: %v", err)
+	}
+
+	environment.reconcile(t)
+
+	deployment, err = deploymentsClient.Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	if _, ok := deployment.Annotations[goodRevisionAnnotation]; !ok {
+		t.Errorf("finished rollout was reverted with the outdated deployment from the cache")
+	}
+	if requeues := environment.reconciler.cache.queue.NumRequeues(types.NamespacedName{Namespace: testNamespace, Name: "web"}); requeues != 1 {
+		t.Errorf("expected the service to be requeued after the conflict, got %d requeues", requeues)
+	}
+}
+
+func TestDeletedQuotasAreRepaired(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	useSeparateNamespaces()
+	config.GlobalPolicies().Defaults.Quota = &config.Quota{CPU: "2", DefaultCPU: "500m"}
+	// the cache watches the namespaces of the mode it was created in
+	environment.reconciler.cache = newClusterCache(environment.clientset)
+	ctx := context.Background()
+	environment.deployServices(t, "web")
+	environment.monitor(t)
+
+	quotasClient := environment.clientset.CoreV1().ResourceQuotas(targetNamespace(testNamespace))
+	err := quotasClient.Delete(ctx, quotaName, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("could not delete resource quota: %v", err)
+	}
+	environment.waitFor(t, "the resource quota to be recreated", func() bool {
+		_, err := quotasClient.Get(ctx, quotaName, metav1.GetOptions{})
+		return err == nil
+	})
+
+	limitRangesClient := environment.clientset.CoreV1().LimitRanges(targetNamespace(testNamespace))
+	limitRange, err := limitRangesClient.Get(ctx, quotaName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get limit range: %v", err)
+	}
+	limitRange.Spec.Limits = nil
+	_, err = limitRangesClient.Update(ctx, limitRange, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("could not update limit range: %v", err)
+	}
+	environment.waitFor(t, "the limit range to be reverted", func() bool {
+		limitRange, err := limitRangesClient.Get(ctx, quotaName, metav1.GetOptions{})
+		return err == nil && len(limitRange.Spec.Limits) > 0
+	})
+}
+
+func TestQueuedServicesInNamespacesWithSlashes(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: "team/web", Name: "api"}
+	_ = environment.storage.SetService(ctx, name.Namespace, name.Name, &protoStorage.Service{Image: "nginx", Replicas: 1})
+
+	environment.reconciler.cache.queue.Add(types.NamespacedName{Namespace: name.Namespace, Name: name.Name})
+	environment.reconciler.processNextService(ctx)
+
+	if !environment.deploymentExists(t, serviceDeploymentName(name)) {
+		t.Errorf("queued service of a namespace containing a slash was not reconciled")
+	}
+}
@@ -0,0 +1,118 @@
+package reconciling
+
+import (
+	"context"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	appsv1 "k8s.io/api/apps/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// deploymentAvailable reports whether all replicas of the current spec of a deployment are available
+func deploymentAvailable(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.ObservedGeneration >= deployment.Generation && deployment.Status.AvailableReplicas >= replicas
+}
+
+// migrateLegacyResources moves a service away from its legacy resource names. The legacy deployments keep serving
+// next to their replacements and are only deleted once the replacements are available.
+func (r *KubernetesReconciler) migrateLegacyResources(ctx context.Context, name *protoStorage.NamespacedName) error {
+	err := r.migrateHistory(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	migrated := true
+	for legacy, current := range map[string]string{
+		legacyServiceDeploymentName(name):   serviceDeploymentName(name),
+		legacyServiceLBDeploymentName(name): serviceLBDeploymentName(name),
+	} {
+		done, err := r.migrateDeployment(ctx, name.Namespace, legacy, current)
+		if err != nil {
+			return err
+		}
+		migrated = migrated && done
+	}
+	if !migrated {
+		return nil
+	}
+
+	// the legacy canary and pull secret are only used by the legacy deployments
+	err = r.deleteLegacy(ctx, name.Namespace, "Deployment", legacyCanaryDeploymentName(name))
+	if err != nil {
+		return err
+	}
+	return r.deleteLegacy(ctx, name.Namespace, "Secret", legacyPullSecretName(name))
+}
+
+// migrateDeployment deletes a legacy deployment once its replacement is available and returns whether it is gone
+func (r *KubernetesReconciler) migrateDeployment(ctx context.Context, namespace string, legacy string, current string) (bool, error) {
+	if len(validation.IsDNS1123Subdomain(legacy)) > 0 {
+		return true, nil // a deployment cannot exist under an invalid name
+	}
+
+	_, err := r.getDeployment(ctx, namespace, legacy)
+	if apiErrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	replacement, err := r.getDeployment(ctx, namespace, current)
+	if err != nil {
+		return false, fmt.Errorf("could not get replacement of legacy deployment %s: %w", legacy, err)
+	}
+	if !deploymentAvailable(replacement) {
+		logger.Infow("waiting for replacement of legacy deployment", "legacy", legacy, "name", current)
+		return false, nil
+	}
+
+	logger.Infow("migrated legacy deployment", "legacy", legacy, "name", current)
+	return true, r.deleteLegacy(ctx, namespace, "Deployment", legacy)
+}
+
+// migrateHistory copies the revision history of a service from its legacy secret
+func (r *KubernetesReconciler) migrateHistory(ctx context.Context, name *protoStorage.NamespacedName) error {
+	legacy := legacyHistorySecretName(name)
+	if len(validation.IsDNS1123Subdomain(legacy)) > 0 {
+		return nil
+	}
+
+	secretsClient := r.clientset.CoreV1().Secrets(targetNamespace(name.Namespace))
+	secret, err := secretsClient.Get(ctx, legacy, metav1.GetOptions{})
+	if apiErrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get legacy revision history: %w", err)
+	}
+
+	_, err = secretsClient.Create(ctx, buildHistorySecret(name, secret.Data[historyDataKey]), metav1.CreateOptions{})
+	if err != nil && !apiErrors.IsAlreadyExists(err) {
+		return fmt.Errorf("could not migrate revision history: %w", err)
+	}
+	return r.deleteLegacy(ctx, name.Namespace, "Secret", legacy)
+}
+
+func (r *KubernetesReconciler) deleteLegacy(ctx context.Context, namespace string, kind string, name string) error {
+	if len(validation.IsDNS1123Subdomain(name)) > 0 {
+		return nil
+	}
+
+	var err error
+	if kind == "Secret" {
+		err = r.clientset.CoreV1().Secrets(targetNamespace(namespace)).Delete(ctx, name, metav1.DeleteOptions{})
+	} else {
+		err = r.clientset.AppsV1().Deployments(targetNamespace(namespace)).Delete(ctx, name, metav1.DeleteOptions{})
+	}
+	if err != nil && !apiErrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete legacy %s %s: %w", kind, name, err)
+	}
+	return nil
+}
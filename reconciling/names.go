@@ -0,0 +1,140 @@
+package reconciling
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"regexp"
+	"strings"
+)
+
+const (
+	nameHashLength = 8
+	// namespaceAnnotation and nameAnnotation hold the exact kuly namespace and service name of resources whose labels
+	// could not hold them
+	namespaceAnnotation = labelPrefix + "namespace"
+	nameAnnotation      = labelPrefix + "name"
+)
+
+var invalidNameCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+// sanitizeName turns a value into lowercase alphanumeric words separated by dashes
+func sanitizeName(value string) string {
+	return strings.Trim(invalidNameCharacters.ReplaceAllString(strings.ToLower(value), "-"), "-")
+}
+
+// resourceName returns a DNS-1123 label for a resource of a service, e.g. svc-<namespace>-<name>-<hash>.
+// Namespace and name are sanitized and truncated to fit, the hash of the exact namespace and name keeps names of
+// different services apart, like namespace "a-b" with service "c" and namespace "a" with service "b-c".
+func resourceName(prefix string, name *protoStorage.NamespacedName, suffix string) string {
+	hash := sha256.Sum256([]byte(name.Namespace + "\x00" + name.Name))
+
+	parts := []string{prefix}
+	fixedLength := len(prefix) + 1 + nameHashLength
+	if suffix != "" {
+		fixedLength += len(suffix) + 1
+	}
+
+	readable := strings.Trim(sanitizeName(name.Namespace)+"-"+sanitizeName(name.Name), "-")
+	if maxLength := validation.DNS1123LabelMaxLength - fixedLength - 1; len(readable) > maxLength {
+		readable = strings.TrimRight(readable[:maxLength], "-")
+	}
+	if readable != "" {
+		parts = append(parts, readable)
+	}
+	if suffix != "" {
+		parts = append(parts, suffix)
+	}
+	parts = append(parts, hex.EncodeToString(hash[:])[:nameHashLength])
+	return strings.Join(parts, "-")
+}
+
+// hashedValue sanitizes a value and adds a hash of the exact value, e.g. <value>-<hash>, at most maxLength long
+func hashedValue(value string, maxLength int) string {
+	hash := sha256.Sum256([]byte(value))
+	hashed := hex.EncodeToString(hash[:])[:nameHashLength]
+
+	readable := sanitizeName(value)
+	if maxReadable := maxLength - nameHashLength - 1; len(readable) > maxReadable {
+		readable = strings.TrimRight(readable[:maxReadable], "-")
+	}
+	if readable == "" {
+		return hashed
+	}
+	return readable + "-" + hashed
+}
+
+// labelValue returns a value that can be used as label. Values that are valid labels are used as is, so selectors of
+// existing resources keep matching, others are sanitized and hashed.
+func labelValue(value string) string {
+	if len(validation.IsValidLabelValue(value)) == 0 {
+		return value
+	}
+	return hashedValue(value, validation.LabelValueMaxLength)
+}
+
+// namespaceName fills a kuly namespace into the namespace name template. Namespaces that make a valid name are used
+// as is, so existing kubernetes namespaces keep their names, others are sanitized and hashed to fit the template.
+func namespaceName(template string, namespace string) string {
+	name := strings.ReplaceAll(template, "{namespace}", namespace)
+	if len(validation.IsDNS1123Label(name)) == 0 {
+		return name
+	}
+
+	placeholders := strings.Count(template, "{namespace}")
+	maxLength := validation.DNS1123LabelMaxLength - len(template) + placeholders*len("{namespace}")
+	if placeholders > 1 {
+		maxLength /= placeholders
+	}
+	return strings.ReplaceAll(template, "{namespace}", hashedValue(namespace, maxLength))
+}
+
+// annotateOwner keeps the kuly namespace and service name of a resource in annotations if its labels could not
+// hold them. An empty name only annotates the namespace.
+func annotateOwner(meta *metav1.ObjectMeta, namespace string, name string) {
+	for annotation, value := range map[string]string{namespaceAnnotation: namespace, nameAnnotation: name} {
+		if value == "" || labelValue(value) == value {
+			continue
+		}
+		if meta.Annotations == nil {
+			meta.Annotations = make(map[string]string)
+		}
+		meta.Annotations[annotation] = value
+	}
+}
+
+// owner returns the kuly namespace and service a resource belongs to, empty if it is not labeled
+func owner(meta metav1.Object) (string, string) {
+	value := func(label string, annotation string) string {
+		if value, ok := meta.GetAnnotations()[annotation]; ok {
+			return value
+		}
+		return meta.GetLabels()[label]
+	}
+	return value(namespaceLabel, namespaceAnnotation), value(nameLabel, nameAnnotation)
+}
+
+// The legacy names were used before names were made unique. Resources are migrated from them while reconciling.
+
+func legacyServiceDeploymentName(name *protoStorage.NamespacedName) string {
+	return fmt.Sprintf("svc-%s-%s", name.Namespace, name.Name)
+}
+
+func legacyServiceLBDeploymentName(name *protoStorage.NamespacedName) string {
+	return fmt.Sprintf("svclb-%s-%s", name.Namespace, name.Name)
+}
+
+func legacyCanaryDeploymentName(name *protoStorage.NamespacedName) string {
+	return fmt.Sprintf("svc-%s-%s-canary", name.Namespace, name.Name)
+}
+
+func legacyHistorySecretName(name *protoStorage.NamespacedName) string {
+	return fmt.Sprintf("svc-%s-%s-history", name.Namespace, name.Name)
+}
+
+func legacyPullSecretName(name *protoStorage.NamespacedName) string {
+	return fmt.Sprintf("svc-%s-%s-pullsecret", name.Namespace, name.Name)
+}
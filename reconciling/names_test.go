@@ -0,0 +1,214 @@
+package reconciling
+
+import (
+	"context"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	appsv1 "k8s.io/api/apps/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	k8sTesting "k8s.io/client-go/testing"
+	"strings"
+	"testing"
+)
+
+func TestResourceNamesAreUniqueAndValid(t *testing.T) {
+	names := []*protoStorage.NamespacedName{
+		{Namespace: "a-b", Name: "c"},
+		{Namespace: "a", Name: "b-c"},
+		{Namespace: "Team_A", Name: "Web.Frontend"},
+		{Namespace: "team-a", Name: "web-frontend"},
+		{Namespace: strings.Repeat("namespace", 10), Name: strings.Repeat("service", 10)},
+		{Namespace: strings.Repeat("namespace", 10), Name: strings.Repeat("service", 11)},
+		{Namespace: "---", Name: "$$$"},
+	}
+
+	seen := make(map[string]*protoStorage.NamespacedName)
+	for _, name := range names {
+		for _, resource := range []string{serviceDeploymentName(name), serviceLBDeploymentName(name), canaryDeploymentName(name), historySecretName(name), pullSecretName(name)} {
+			if problems := validation.IsDNS1123Label(resource); len(problems) > 0 {
+				t.Errorf("%s is not a valid name: %v", resource, problems)
+			}
+			if other, ok := seen[resource]; ok {
+				t.Errorf("%s is used by %s/%s and %s/%s", resource, other.Namespace, other.Name, name.Namespace, name.Name)
+			}
+			seen[resource] = name
+		}
+	}
+
+	if serviceDeploymentName(names[0]) != serviceDeploymentName(&protoStorage.NamespacedName{Namespace: "a-b", Name: "c"}) {
+		t.Errorf("resource names are not stable")
+	}
+}
+
+func TestLabelValuesAndNamespaceNames(t *testing.T) {
+	for _, test := range []struct {
+		value     string
+		unchanged bool
+	}{
+		{value: "web", unchanged: true},
+		{value: "Team_A.web", unchanged: true},
+		{value: "team a"},
+		{value: "-web"},
+		{value: strings.Repeat("service", 10)},
+	} {
+		label := labelValue(test.value)
+		if problems := validation.IsValidLabelValue(label); len(problems) > 0 {
+			t.Errorf("label value %s of %q is not valid: %v", label, test.value, problems)
+		}
+		if (label == test.value) != test.unchanged {
+			t.Errorf("expected the label value of %q to be unchanged %v, got %s", test.value, test.unchanged, label)
+		}
+
+		name := namespaceName("kuly-{namespace}", test.value)
+		if problems := validation.IsDNS1123Label(name); len(problems) > 0 {
+			t.Errorf("namespace name %s of %q is not valid: %v", name, test.value, problems)
+		}
+	}
+
+	if namespaceName("kuly-{namespace}", "team-a") != "kuly-team-a" {
+		t.Errorf("valid namespace names must not change")
+	}
+	if labelValue("team a") == labelValue("team-a") || namespaceName("kuly-{namespace}", "Team-A") == namespaceName("kuly-{namespace}", "team-a") {
+		t.Errorf("hashed values collide with valid ones")
+	}
+}
+
+func TestServicesWithInvalidLabelValues(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	useSeparateNamespaces()
+	ctx := context.Background()
+	namespace := "Team A"
+	service := strings.Repeat("service", 10)
+	_ = environment.storage.SetService(ctx, namespace, service, &protoStorage.Service{Image: "nginx", Replicas: 1})
+
+	err := environment.reconciler.ReconcileDeployments(ctx, namespace)
+	if err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+
+	name := &protoStorage.NamespacedName{Namespace: namespace, Name: service}
+	deployment, err := environment.clientset.AppsV1().Deployments(targetNamespace(namespace)).Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	for _, labels := range []map[string]string{deployment.Labels, deployment.Spec.Selector.MatchLabels, deployment.Spec.Template.Labels} {
+		for key, value := range labels {
+			if problems := validation.IsValidLabelValue(value); len(problems) > 0 {
+				t.Errorf("label %s=%s is not valid: %v", key, value, problems)
+			}
+		}
+	}
+	for _, meta := range []metav1.Object{deployment, &deployment.Spec.Template} {
+		if ownerNamespace, ownerName := owner(meta); ownerNamespace != namespace || ownerName != service {
+			t.Errorf("expected owner %s/%s, got %s/%s", namespace, service, ownerNamespace, ownerName)
+		}
+	}
+
+	// the kubernetes namespace is kept as long as its kuly namespace exists
+	err = environment.reconciler.ReconcileNamespaces(ctx, []string{namespace})
+	if err != nil {
+		t.Fatalf("could not reconcile namespaces: %v", err)
+	}
+	_, err = environment.clientset.CoreV1().Namespaces().Get(ctx, targetNamespace(namespace), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("namespace is gone: %v", err)
+	}
+}
+
+// preserveDeploymentStatus makes updates of the fake cluster keep the status of deployments like a real API server does
+func (environment *testEnvironment) preserveDeploymentStatus() {
+	environment.clientset.PrependReactor("update", "deployments", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" {
+			return false, nil, nil
+		}
+		deployment := action.(k8sTesting.UpdateAction).GetObject().(*appsv1.Deployment)
+		existing, err := environment.clientset.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), deployment.Namespace, deployment.Name)
+		if err == nil {
+			deployment.Status = existing.(*appsv1.Deployment).Status
+		}
+		return false, nil, nil
+	})
+}
+
+func TestLegacyDeploymentsAreReplacedWhenAvailable(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	service := &protoStorage.Service{Image: "nginx", Replicas: 1}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", service)
+	deploymentsClient := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace))
+	environment.preserveDeploymentStatus()
+
+	for _, legacy := range []string{legacyServiceDeploymentName(name), legacyServiceLBDeploymentName(name)} {
+		deployment := buildDeploymentFromService(name, service)
+		deployment.Name = legacy
+		_, err := deploymentsClient.Create(ctx, deployment, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("could not create legacy deployment: %v", err)
+		}
+	}
+
+	environment.reconcile(t)
+	if !environment.deploymentExists(t, serviceDeploymentName(name)) {
+		t.Fatalf("replacement deployment was not created")
+	}
+	if !environment.deploymentExists(t, legacyServiceDeploymentName(name)) {
+		t.Fatalf("legacy deployment was deleted before its replacement was available")
+	}
+
+	for _, current := range []string{serviceDeploymentName(name), serviceLBDeploymentName(name)} {
+		deployment, _ := deploymentsClient.Get(ctx, current, metav1.GetOptions{})
+		deployment.Status.AvailableReplicas = *deployment.Spec.Replicas
+		_, err := deploymentsClient.UpdateStatus(ctx, deployment, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatalf("could not update status: %v", err)
+		}
+	}
+
+	environment.reconcile(t)
+	for _, legacy := range []string{legacyServiceDeploymentName(name), legacyServiceLBDeploymentName(name)} {
+		_, err := deploymentsClient.Get(ctx, legacy, metav1.GetOptions{})
+		if !apiErrors.IsNotFound(err) {
+			t.Errorf("legacy deployment %s still exists: %v", legacy, err)
+		}
+	}
+}
+
+func TestDeploymentSelectorsDoNotOverlap(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	ctx := context.Background()
+	// the legacy name is listed after the current one
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web.v2"}
+	service := &protoStorage.Service{Image: "nginx", Replicas: 1}
+	_ = environment.storage.SetService(ctx, testNamespace, name.Name, service)
+	deploymentsClient := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace))
+
+	// legacy deployments were created without the deployment label
+	legacy := buildDeploymentFromService(name, service)
+	legacy.Name = legacyServiceDeploymentName(name)
+	delete(legacy.Spec.Selector.MatchLabels, deploymentLabel)
+	delete(legacy.Spec.Template.Labels, deploymentLabel)
+	_, err := deploymentsClient.Create(ctx, legacy, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("could not create legacy deployment: %v", err)
+	}
+	environment.reconcile(t)
+
+	current, err := deploymentsClient.Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get deployment: %v", err)
+	}
+	canary := buildCanaryDeploymentFromService(name, service, 1)
+	selector := labels.SelectorFromSet(current.Spec.Selector.MatchLabels)
+	for _, other := range []*appsv1.Deployment{legacy, canary} {
+		if selector.Matches(labels.Set(other.Spec.Template.Labels)) {
+			t.Errorf("selector of %s matches the pods of %s", current.Name, other.Name)
+		}
+	}
+	if labels.SelectorFromSet(canary.Spec.Selector.MatchLabels).Matches(labels.Set(current.Spec.Template.Labels)) {
+		t.Errorf("selector of the canary matches the pods of %s", current.Name)
+	}
+}
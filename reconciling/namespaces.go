@@ -0,0 +1,127 @@
+package reconciling
+
+import (
+	"context"
+	"fmt"
+	"github.com/kulycloud/service-manager-k8s/config"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"strings"
+)
+
+func separateNamespaces() bool {
+	return config.GlobalConfig().NamespaceMode == config.NamespaceModeSeparate
+}
+
+// targetNamespace returns the kubernetes namespace the resources of a kuly namespace are placed in
+func targetNamespace(namespace string) string {
+	if !separateNamespaces() {
+		return config.GlobalConfig().ServiceNamespace
+	}
+	return namespaceName(config.GlobalConfig().NamespaceNameTemplate, namespace)
+}
+
+// watchedNamespace returns the kubernetes namespace that has to be watched to see all managed resources
+func watchedNamespace() string {
+	if !separateNamespaces() {
+		return config.GlobalConfig().ServiceNamespace
+	}
+	return metav1.NamespaceAll
+}
+
+func (r *KubernetesReconciler) ensureNamespace(ctx context.Context, namespace string) error {
+	if !separateNamespaces() {
+		return nil
+	}
+
+	namespacesClient := r.clientset.CoreV1().Namespaces()
+	desired := buildNamespace(namespace)
+	if problems := validation.IsDNS1123Label(desired.Name); len(problems) > 0 {
+		return fmt.Errorf("invalid kubernetes namespace %s for kuly namespace %s: %s", desired.Name, namespace, strings.Join(problems, ", "))
+	}
+
+	existing, err := namespacesClient.Get(ctx, desired.Name, metav1.GetOptions{})
+	if err != nil {
+		if !apiErrors.IsNotFound(err) {
+			return fmt.Errorf("could not get namespace %s: %w", desired.Name, err)
+		}
+
+		logger.Infow("creating namespace", "namespace", namespace, "kubernetesNamespace", desired.Name)
+		_, err = namespacesClient.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("could not create namespace %s: %w", desired.Name, err)
+		}
+		return nil
+	}
+
+	// Namespaces that were not created by kuly are never adopted, they would be deleted with everything in them
+	// once the kuly namespace is removed
+	if _, ok := existing.Labels[namespaceLabel]; !ok {
+		return fmt.Errorf("%w: namespace %s exists and is not managed by kuly", ErrNotAdoptable, desired.Name)
+	}
+	if ownerNamespace, _ := owner(existing); ownerNamespace != namespace {
+		return fmt.Errorf("namespace %s already belongs to kuly namespace %s", desired.Name, ownerNamespace)
+	}
+
+	if existing.Labels[typeLabel] == typeLabelNamespace {
+		return nil
+	}
+
+	existing.Labels[typeLabel] = typeLabelNamespace
+	_, err = namespacesClient.Update(ctx, existing, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not label namespace %s: %w", desired.Name, err)
+	}
+	return nil
+}
+
+func (r *KubernetesReconciler) ReconcileNamespaces(ctx context.Context, namespaces []string) error {
+	if !separateNamespaces() {
+		return nil
+	}
+
+	namespacesClient := r.clientset.CoreV1().Namespaces()
+	existing, err := namespacesClient.List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", typeLabel, typeLabelNamespace)})
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, namespace := range namespaces {
+		known[namespace] = true
+	}
+
+	deletions := make([]string, 0)
+	deleted := make(map[string]string)
+	total := 0
+	for _, ns := range existing.Items {
+		if ns.DeletionTimestamp != nil {
+			continue // already being deleted
+		}
+		total++
+		namespace, _ := owner(&ns)
+		if known[namespace] {
+			continue
+		}
+
+		// kuly namespace no longer exists
+		deletions = append(deletions, namespace)
+		deleted[namespace] = ns.Name
+	}
+
+	err = r.guardNamespaceDeletions(deletions, total)
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range deletions {
+		logger.Infow("deleting namespace", "namespace", namespace, "kubernetesNamespace", deleted[namespace])
+		err = namespacesClient.Delete(ctx, deleted[namespace], metav1.DeleteOptions{})
+		if err != nil && !apiErrors.IsNotFound(err) {
+			logger.Warnw("Could not delete Namespace", "err", err, "kubernetesNamespace", deleted[namespace])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+// useSeparateNamespaces switches the test environment to one kubernetes namespace per kuly namespace
+func useSeparateNamespaces() {
+	config.GlobalConfig().NamespaceMode = config.NamespaceModeSeparate
+	config.GlobalConfig().NamespaceNameTemplate = "kuly-{namespace}"
+}
+
+func TestUnlabeledNamespaceIsNotAdopted(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	useSeparateNamespaces()
+	ctx := context.Background()
+	_, err := environment.clientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: targetNamespace(testNamespace)},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("could not create namespace: %v", err)
+	}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx", Replicas: 1})
+
+	err = environment.reconciler.ReconcileDeployments(ctx, testNamespace)
+	if !errors.Is(err, ErrNotAdoptable) {
+		t.Fatalf("expected the namespace not to be adopted, got %v", err)
+	}
+
+	namespace, err := environment.clientset.CoreV1().Namespaces().Get(ctx, targetNamespace(testNamespace), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get namespace: %v", err)
+	}
+	if len(namespace.Labels) > 0 {
+		t.Errorf("unmanaged namespace was labeled: %v", namespace.Labels)
+	}
+}
+
+func TestDeletionGuardBlocksNamespaceDeletion(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	useSeparateNamespaces()
+	config.GlobalConfig().DeletionGuardPercent = 50
+	ctx := context.Background()
+	for _, namespace := range []string{"a", "b", "c", "d"} {
+		_, err := environment.clientset.CoreV1().Namespaces().Create(ctx, buildNamespace(namespace), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("could not create namespace: %v", err)
+		}
+	}
+
+	// a truncated namespace list from storage
+	err := environment.reconciler.ReconcileNamespaces(ctx, []string{"a"})
+	if !errors.Is(err, ErrDeletionBlocked) {
+		t.Fatalf("expected the deletion to be blocked, got %v", err)
+	}
+	namespaces, _ := environment.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if len(namespaces.Items) != 4 {
+		t.Fatalf("namespaces were deleted despite the guard, %d are left", len(namespaces.Items))
+	}
+
+	err = environment.reconciler.ConfirmDeletion(ctx, NamespaceDeletions)
+	if err != nil {
+		t.Fatalf("could not confirm deletion: %v", err)
+	}
+	err = environment.reconciler.ReconcileNamespaces(ctx, []string{"a"})
+	if err != nil {
+		t.Fatalf("could not reconcile namespaces after the confirmation: %v", err)
+	}
+	namespaces, _ = environment.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if len(namespaces.Items) != 1 || namespaces.Items[0].Name != targetNamespace("a") {
+		t.Errorf("expected only namespace a to be left, got %d namespaces", len(namespaces.Items))
+	}
+}
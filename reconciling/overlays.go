@@ -0,0 +1,83 @@
+package reconciling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// applyOverlays patches a rendered deployment with the overlays of its service and checks that the
+// patches left the parts alone that the manager relies on
+func applyOverlays(deployment *appsv1.Deployment, overlays []config.Overlay) (*appsv1.Deployment, error) {
+	if len(overlays) == 0 {
+		return deployment, nil
+	}
+
+	document, err := json.Marshal(deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, overlay := range overlays {
+		if len(overlay.StrategicMerge) > 0 {
+			document, err = strategicpatch.StrategicMergePatch(document, overlay.StrategicMerge, &appsv1.Deployment{})
+		} else {
+			var patch jsonpatch.Patch
+			patch, err = jsonpatch.DecodePatch(overlay.JSONPatch)
+			if err == nil {
+				document, err = patch.Apply(document)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not apply overlay %d: %w", i, err)
+		}
+	}
+
+	patched := &appsv1.Deployment{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(patched)
+	if err != nil {
+		return nil, fmt.Errorf("overlays produce an invalid deployment: %w", err)
+	}
+
+	err = validateOverlayResult(deployment, patched)
+	if err != nil {
+		return nil, fmt.Errorf("overlays produce an invalid deployment: %w", err)
+	}
+	return patched, nil
+}
+
+func validateOverlayResult(rendered *appsv1.Deployment, patched *appsv1.Deployment) error {
+	if patched.Name != rendered.Name || patched.Namespace != rendered.Namespace {
+		return fmt.Errorf("name and namespace must not be changed")
+	}
+	if !equality.Semantic.DeepEqual(patched.Spec.Selector, rendered.Spec.Selector) {
+		return fmt.Errorf("selector must not be changed")
+	}
+	for key, value := range rendered.Labels {
+		if patched.Labels[key] != value {
+			return fmt.Errorf("label %s must not be changed", key)
+		}
+	}
+	for key, value := range rendered.Spec.Template.Labels {
+		if patched.Spec.Template.Labels[key] != value {
+			return fmt.Errorf("pod label %s must not be changed", key)
+		}
+	}
+	if patched.Annotations[revisionAnnotation] != rendered.Annotations[revisionAnnotation] {
+		return fmt.Errorf("annotation %s must not be changed", revisionAnnotation)
+	}
+
+	for _, container := range patched.Spec.Template.Spec.Containers {
+		if container.Name == serviceContainerName {
+			return nil
+		}
+	}
+	return fmt.Errorf("container %s must not be removed", serviceContainerName)
+}
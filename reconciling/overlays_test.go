@@ -0,0 +1,103 @@
+package reconciling
+
+import (
+	"context"
+	"encoding/json"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"strings"
+	"testing"
+)
+
+func TestApplyOverlays(t *testing.T) {
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+
+	tests := []struct {
+		name     string
+		overlays []config.Overlay
+		err      string
+		check    func(t *testing.T, containers int, nodeSelector map[string]string, annotation string)
+	}{
+		{
+			name: "strategic merge adds a sidecar",
+			overlays: []config.Overlay{{StrategicMerge: json.RawMessage(`{"spec":{"template":{"spec":{
+				"containers":[{"name":"sidecar","image":"envoy"}],"nodeSelector":{"pool":"web"}}}}}`)}},
+			check: func(t *testing.T, containers int, nodeSelector map[string]string, annotation string) {
+				if containers != 2 {
+					t.Errorf("expected the sidecar to be merged next to the service container, got %d containers", containers)
+				}
+				if nodeSelector["pool"] != "web" {
+					t.Errorf("expected the node selector to be set, got %v", nodeSelector)
+				}
+			},
+		},
+		{
+			name: "json patches are applied in order",
+			overlays: []config.Overlay{
+				{JSONPatch: json.RawMessage(`[{"op":"add","path":"/metadata/annotations/team","value":"a"}]`)},
+				{JSONPatch: json.RawMessage(`[{"op":"replace","path":"/metadata/annotations/team","value":"b"}]`)},
+			},
+			check: func(t *testing.T, containers int, nodeSelector map[string]string, annotation string) {
+				if annotation != "b" {
+					t.Errorf("expected the later overlay to win, got annotation %q", annotation)
+				}
+			},
+		},
+		{
+			name:     "invalid json patch",
+			overlays: []config.Overlay{{JSONPatch: json.RawMessage(`[{"op":"replace","path":"/spec/missing/field","value":1}]`)}},
+			err:      "could not apply overlay 0",
+		},
+		{
+			name:     "selector must not change",
+			overlays: []config.Overlay{{StrategicMerge: json.RawMessage(`{"spec":{"selector":{"matchLabels":{"extra":"label"}}}}`)}},
+			err:      "selector must not be changed",
+		},
+		{
+			name:     "service container must not be removed",
+			overlays: []config.Overlay{{JSONPatch: json.RawMessage(`[{"op":"remove","path":"/spec/template/spec/containers/0"}]`)}},
+			err:      "container app-container must not be removed",
+		},
+		{
+			name:     "unknown fields",
+			overlays: []config.Overlay{{StrategicMerge: json.RawMessage(`{"spec":{"replicaz":3}}`)}},
+			err:      "overlays produce an invalid deployment",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployment, err := applyOverlays(buildDeploymentFromService(name, &protoStorage.Service{Image: "nginx", Replicas: 1}), test.overlays)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not apply overlays: %v", err)
+			}
+			test.check(t, len(deployment.Spec.Template.Spec.Containers), deployment.Spec.Template.Spec.NodeSelector, deployment.Annotations["team"])
+		})
+	}
+}
+
+func TestInvalidOverlayFailsService(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	config.GlobalPolicies().Namespaces = map[string]config.NamespacePolicy{testNamespace: {
+		Services: map[string]config.ServicePolicy{"web": {
+			Overlays: []config.Overlay{{JSONPatch: json.RawMessage(`[{"op":"remove","path":"/spec/selector"}]`)}},
+		}},
+	}}
+	_ = environment.storage.SetService(context.Background(), testNamespace, "web", &protoStorage.Service{Image: "nginx", Replicas: 1})
+
+	environment.reconcile(t)
+
+	status, _ := environment.reconciler.statuses.get(testNamespace, "web")
+	if status.Phase != StatusFailed {
+		t.Errorf("expected status %s, got %s", StatusFailed, status.Phase)
+	}
+	if environment.deploymentExists(t, serviceDeploymentName(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"})) {
+		t.Errorf("deployment was created despite the invalid overlay")
+	}
+}
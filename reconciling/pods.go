@@ -4,69 +4,69 @@ import (
 	"context"
 	"fmt"
 	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
 	"github.com/kulycloud/service-manager-k8s/communication"
 	"github.com/kulycloud/service-manager-k8s/config"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/tools/cache"
 )
 
+// MonitorCluster watches all resources of the manager. Pod changes update the load balancers,
+// changes to other resources reconcile the service they belong to.
 func (r *KubernetesReconciler) MonitorCluster(ctx context.Context) error {
-
-	watchlist := cache.NewListWatchFromClient(
-		r.clientset.CoreV1().RESTClient(),
-		string(corev1.ResourcePods),
-		config.GlobalConfig.ServiceNamespace,
-		fields.Everything(),
-	)
-
-	_, controller := cache.NewInformer(
-		watchlist,
-		&corev1.Pod{},
-		0, //Duration is int64
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				pod, ok := obj.(*corev1.Pod)
-				if !ok {
-					logger.Warnw("could not cast")
-					return
-				}
-				r.processPod(ctx, pod)
-			},
-			DeleteFunc: func(obj interface{}) {
-				pod, ok := obj.(*corev1.Pod)
-				if !ok {
-					logger.Warnw("could not cast")
-					return
-				}
-				r.processPod(ctx, pod)
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				pod, ok := newObj.(*corev1.Pod)
-				if !ok {
-					logger.Warnw("could not cast")
-					return
-				}
-				r.processPod(ctx, pod)
-			},
+	r.cache.factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				logger.Warnw("could not cast")
+				return
+			}
+			r.processPod(ctx, pod)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				logger.Warnw("could not cast")
+				return
+			}
+			r.processPod(ctx, pod)
 		},
-	)
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			pod, ok := newObj.(*corev1.Pod)
+			if !ok {
+				logger.Warnw("could not cast")
+				return
+			}
+			r.processPod(ctx, pod)
+		},
+	})
+	r.cache.factory.Apps().V1().Deployments().Informer().AddEventHandler(r.deploymentHandlers())
+	r.cache.factory.Core().V1().Secrets().Informer().AddEventHandler(r.secretHandlers())
+	if separateNamespaces() {
+		r.cache.factory.Core().V1().Namespaces().Informer().AddEventHandler(r.namespaceHandlers())
+		r.cache.factory.Core().V1().ResourceQuotas().Informer().AddEventHandler(r.quotaHandlers())
+		r.cache.factory.Core().V1().LimitRanges().Informer().AddEventHandler(r.quotaHandlers())
+	}
+
+	err := r.cache.start(ctx)
+	if err != nil {
+		return err
+	}
+	go r.processQueue(ctx)
 
-	stop := make(chan struct{})
-	defer close(stop)
-	controller.Run(stop)
+	<-ctx.Done()
+	r.cache.queue.ShutDown()
 	return nil
 }
 
 func (r *KubernetesReconciler) processPod(ctx context.Context, pod *corev1.Pod) {
-	serviceName, ok := pod.Labels[nameLabel]
-	if !ok {
-		return // no serviceName set -> Not our pod
-	}
-	namespace, ok := pod.Labels[namespaceLabel]
-	if !ok {
-		return // no namespace set -> Not our pod
+	namespace, serviceName := owner(pod)
+	if namespace == "" || serviceName == "" {
+		return // no owner set -> Not our pod
 	}
 
 	err := r.ReconcilePods(ctx, namespace, serviceName)
@@ -89,11 +89,15 @@ func isPodReady(pod *corev1.Pod) bool {
 }
 
 func (r *KubernetesReconciler) getRunningPodEndpointsForServiceAndType(ctx context.Context, namespace string, serviceName string, typeName string, port uint32) ([]*protoCommon.Endpoint, error) {
-	return r.getRunningPodEndpointsFromListOptions(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s,%s=%s,%s=%s", namespaceLabel, namespace, nameLabel, serviceName, typeLabel, typeName)}, port)
+	return r.getRunningPodEndpointsFromListOptions(ctx, targetNamespace(namespace), metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s,%s=%s,%s=%s,%s!=%s", namespaceLabel, labelValue(namespace), nameLabel, labelValue(serviceName), typeLabel, typeName, trackLabel, trackCanary)}, port)
+}
+
+func (r *KubernetesReconciler) getRunningCanaryEndpointsForService(ctx context.Context, namespace string, serviceName string, port uint32) ([]*protoCommon.Endpoint, error) {
+	return r.getRunningPodEndpointsFromListOptions(ctx, targetNamespace(namespace), metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s,%s=%s,%s=%s,%s=%s", namespaceLabel, labelValue(namespace), nameLabel, labelValue(serviceName), typeLabel, typeLabelService, trackLabel, trackCanary)}, port)
 }
 
-func (r *KubernetesReconciler) getRunningPodEndpointsFromListOptions(ctx context.Context, options metav1.ListOptions, port uint32) ([]*protoCommon.Endpoint, error) {
-	pods, err := r.clientset.CoreV1().Pods(config.GlobalConfig.ServiceNamespace).List(ctx, options)
+func (r *KubernetesReconciler) getRunningPodEndpointsFromListOptions(ctx context.Context, kubernetesNamespace string, options metav1.ListOptions, port uint32) ([]*protoCommon.Endpoint, error) {
+	pods, err := r.clientset.CoreV1().Pods(kubernetesNamespace).List(ctx, options)
 	if err != nil {
 		return nil, err
 	}
@@ -120,34 +124,63 @@ func (r *KubernetesReconciler) getRunningPodEndpointsFromListOptions(ctx context
 }
 
 func (r *KubernetesReconciler) ReconcilePods(ctx context.Context, namespace string, serviceName string) error {
-	lbs, err := r.getRunningPodEndpointsForServiceAndType(ctx, namespace, serviceName, typeLabelLB, config.GlobalConfig.LoadBalancerControlPort)
+	lbs, err := r.getRunningPodEndpointsForServiceAndType(ctx, namespace, serviceName, typeLabelLB, config.GlobalConfig().LoadBalancerControlPort)
 	if err != nil {
 		return err
 	}
 
-	services, err := r.getRunningPodEndpointsForServiceAndType(ctx, namespace, serviceName, typeLabelService, config.GlobalConfig.HTTPPort)
+	services, err := r.getRunningPodEndpointsForServiceAndType(ctx, namespace, serviceName, typeLabelService, config.GlobalConfig().HTTPPort)
 	if err != nil {
 		return err
 	}
 
+	canaries, err := r.getRunningCanaryEndpointsForService(ctx, namespace, serviceName, config.GlobalConfig().HTTPPort)
+	if err != nil {
+		return err
+	}
+
+	weight, err := r.canaryWeight(ctx, &protoStorage.NamespacedName{Namespace: namespace, Name: serviceName})
+	if err != nil {
+		return err
+	}
+	services = weightEndpoints(services, canaries, weight)
+	storageEndpoints := r.storage.StorageEndpoints()
+
+	frozen := r.Frozen()
+	if frozen {
+		// The load balancers are served their last endpoints until storage is available again, load balancers
+		// that start while frozen get them as well. Only endpoints of pods that are gone are dropped.
+		// Services that were not pushed before, e.g. after a restart of the manager, get their running pods.
+		if last, ok := r.pushed.get(namespace, serviceName); ok {
+			services = frozenEndpoints(last.services, services)
+			storageEndpoints = last.storage
+		}
+	}
+
 	communicator, err := communication.NewMultiLoadBalancerCommunicator(lbs)
 	if err != nil {
 		logger.Warnw("error connecting to load balancers", "error", err, "namespace", namespace, "service", serviceName)
 	}
 
-	err = communicator.Update(ctx, services, r.storage.Endpoints)
+	err = communicator.Update(ctx, services, storageEndpoints)
+	if !frozen {
+		r.pushed.set(namespace, serviceName, &endpointSet{services: services, storage: storageEndpoints})
+	}
 
 	if err != nil {
 		logger.Warnw("error connecting to load balancers", "error", err, "namespace", namespace, "service", serviceName)
 		return err
 	}
+	if frozen {
+		return nil // storage is not written while frozen
+	}
 
-	lbHttpPorts, err := r.getRunningPodEndpointsForServiceAndType(ctx, namespace, serviceName, typeLabelLB, config.GlobalConfig.HTTPPort)
+	lbHttpPorts, err := r.getRunningPodEndpointsForServiceAndType(ctx, namespace, serviceName, typeLabelLB, config.GlobalConfig().HTTPPort)
 	if err != nil {
 		return err
 	}
 
-	err = r.storage.SetServiceLBEndpoints(ctx, namespace, serviceName, lbHttpPorts)
+	err = r.endpoints.set(ctx, r.cluster, namespace, serviceName, lbHttpPorts)
 	if err != nil {
 		return fmt.Errorf("could not set LoadBalancers in storage: %w", err)
 	}
@@ -156,7 +189,11 @@ func (r *KubernetesReconciler) ReconcilePods(ctx context.Context, namespace stri
 }
 
 func (r *KubernetesReconciler) PropagateStorageToLoadBalancers(ctx context.Context, endpoints []*protoCommon.Endpoint) {
-	lbEndpoints, err := r.getRunningPodEndpointsFromListOptions(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", typeLabel, typeLabelLB)}, config.GlobalConfig.LoadBalancerControlPort)
+	if r.Frozen() {
+		return
+	}
+
+	lbEndpoints, err := r.getRunningPodEndpointsFromListOptions(ctx, watchedNamespace(), metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", typeLabel, typeLabelLB)}, config.GlobalConfig().LoadBalancerControlPort)
 	if err != nil {
 		logger.Warnf("error getting load balancers from cluster", "error", err)
 		return
@@ -172,3 +209,32 @@ func (r *KubernetesReconciler) PropagateStorageToLoadBalancers(ctx context.Conte
 		logger.Warnf("error propagating storage to load balancers", "error", err)
 	}
 }
+
+// ResyncLoadBalancers pushes storage and service endpoints to the load balancers of every service again
+func (r *KubernetesReconciler) ResyncLoadBalancers(ctx context.Context, namespace string) error {
+	kubernetesNamespace := watchedNamespace()
+	selector := fmt.Sprintf("%s=%s", typeLabel, typeLabelLB)
+	if namespace != "" {
+		kubernetesNamespace = targetNamespace(namespace)
+		selector = fmt.Sprintf("%s,%s=%s", selector, namespaceLabel, labelValue(namespace))
+	}
+
+	loadBalancers, err := r.clientset.AppsV1().Deployments(kubernetesNamespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, lb := range loadBalancers.Items {
+		lbNamespace, lbName := owner(&lb)
+		err = r.ReconcilePods(ctx, lbNamespace, lbName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", lbNamespace, lbName, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("could not resync %d of %d services, first error: %w", len(errs), len(loadBalancers.Items), errs[0])
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package reconciling
+
+import (
+	"context"
+	"fmt"
+	protoCommon "github.com/kulycloud/protocol/common"
+	"reflect"
+	"testing"
+)
+
+func TestReconcilePodsPropagatesEndpoints(t *testing.T) {
+	lb, lbPort := startFakeLoadBalancer(t)
+	environment := newTestEnvironment(t, lbPort)
+	environment.storage.endpoints = []*protoCommon.Endpoint{{Host: "storage", Port: 12270}}
+
+	environment.addPod(t, "lb-1", typeLabelLB, "web", "127.0.0.1", true)
+	environment.addPod(t, "web-1", typeLabelService, "web", "10.0.0.1", true)
+	environment.addPod(t, "web-2", typeLabelService, "web", "10.0.0.2", true)
+	environment.addPod(t, "web-3", typeLabelService, "web", "10.0.0.3", false)
+	environment.addPod(t, "other-1", typeLabelService, "other", "10.0.1.1", true)
+
+	err := environment.reconciler.ReconcilePods(context.Background(), testNamespace, "web")
+	if err != nil {
+		t.Fatalf("could not reconcile pods: %v", err)
+	}
+
+	endpoints, storageEndpoints := lb.received()
+	expected := []string{fmt.Sprintf("10.0.0.1:%d", testHTTPPort), fmt.Sprintf("10.0.0.2:%d", testHTTPPort)}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("expected load balancer endpoints %v, got %v", expected, endpoints)
+	}
+	if !reflect.DeepEqual(storageEndpoints, []string{"storage:12270"}) {
+		t.Errorf("expected storage endpoints [storage:12270], got %v", storageEndpoints)
+	}
+
+	lbEndpoints := endpointStrings(environment.storage.lbEndpoints[statusKey(testNamespace, "web")])
+	expected = []string{fmt.Sprintf("127.0.0.1:%d", testHTTPPort)}
+	if !reflect.DeepEqual(lbEndpoints, expected) {
+		t.Errorf("expected load balancers %v in storage, got %v", expected, lbEndpoints)
+	}
+}
+
+func TestPropagateStorageToLoadBalancers(t *testing.T) {
+	lb, lbPort := startFakeLoadBalancer(t)
+	environment := newTestEnvironment(t, lbPort)
+	environment.addPod(t, "lb-1", typeLabelLB, "web", "127.0.0.1", true)
+
+	environment.reconciler.PropagateStorageToLoadBalancers(context.Background(), []*protoCommon.Endpoint{
+		{Host: "storage-1", Port: 12270},
+		{Host: "storage-2", Port: 12270},
+	})
+
+	_, storageEndpoints := lb.received()
+	expected := []string{"storage-1:12270", "storage-2:12270"}
+	if !reflect.DeepEqual(storageEndpoints, expected) {
+		t.Errorf("expected storage endpoints %v, got %v", expected, storageEndpoints)
+	}
+}
@@ -0,0 +1,208 @@
+package reconciling
+
+import (
+	"context"
+	"fmt"
+	"github.com/kulycloud/service-manager-k8s/config"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const minimumKubernetesMinor = 16
+
+// permission is an access the manager needs in its kubernetes namespaces
+type permission struct {
+	group    string
+	resource string
+	verbs    []string
+	// clusterScoped permissions are checked without a namespace
+	clusterScoped bool
+}
+
+func requiredPermissions() []permission {
+	permissions := []permission{
+		{resource: "pods", verbs: []string{"get", "list", "watch"}},
+		{group: "apps", resource: "deployments", verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+		{resource: "secrets", verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+		{resource: "events", verbs: []string{"create"}},
+	}
+
+	if separateNamespaces() {
+		permissions = append(permissions,
+			permission{resource: "namespaces", verbs: []string{"get", "list", "watch", "create", "update", "delete"}, clusterScoped: true},
+			permission{resource: "resourcequotas", verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+			permission{resource: "limitranges", verbs: []string{"get", "list", "watch", "create", "update", "delete"}},
+		)
+	} else {
+		permissions = append(permissions, permission{resource: "namespaces", verbs: []string{"get", "create"}, clusterScoped: true})
+	}
+	return permissions
+}
+
+// requiredResources are the API resources the manager uses, by group version
+var requiredResources = map[string][]string{
+	"v1":                      {"pods", "secrets", "events", "namespaces", "resourcequotas", "limitranges"},
+	"apps/v1":                 {"deployments"},
+	"authorization.k8s.io/v1": {"selfsubjectaccessreviews"},
+}
+
+type PreflightCheck struct {
+	Name    string
+	OK      bool
+	Message string
+}
+
+// PreflightReport lists whether the cluster is compatible and the manager has all permissions it needs
+type PreflightReport struct {
+	Checks []*PreflightCheck
+}
+
+func (report *PreflightReport) add(name string, err error) {
+	check := &PreflightCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Message = err.Error()
+	}
+	report.Checks = append(report.Checks, check)
+}
+
+func (report *PreflightReport) Failed() bool {
+	for _, check := range report.Checks {
+		if !check.OK {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *PreflightReport) String() string {
+	builder := strings.Builder{}
+	for _, check := range report.Checks {
+		if check.OK {
+			builder.WriteString(fmt.Sprintf("[ OK ] %s\n", check.Name))
+		} else {
+			builder.WriteString(fmt.Sprintf("[FAIL] %s: %s\n", check.Name, check.Message))
+		}
+	}
+	return builder.String()
+}
+
+// Preflight checks the version and API groups of the cluster and all permissions of the manager
+func (r *KubernetesReconciler) Preflight(ctx context.Context) *PreflightReport {
+	report := &PreflightReport{}
+	prefix := ""
+	if r.cluster != "" {
+		prefix = fmt.Sprintf("cluster %s: ", r.cluster)
+	}
+
+	report.add(prefix+"kubernetes version", r.checkVersion())
+
+	groupVersions := make([]string, 0, len(requiredResources))
+	for groupVersion := range requiredResources {
+		groupVersions = append(groupVersions, groupVersion)
+	}
+	sort.Strings(groupVersions)
+	for _, groupVersion := range groupVersions {
+		report.add(fmt.Sprintf("%sAPI %s", prefix, groupVersion), r.checkResources(groupVersion, requiredResources[groupVersion]))
+	}
+
+	for _, permission := range requiredPermissions() {
+		resource := permission.resource
+		if permission.group != "" {
+			resource += "." + permission.group
+		}
+		for _, verb := range permission.verbs {
+			report.add(fmt.Sprintf("%spermission %s %s", prefix, verb, resource), r.checkPermission(ctx, permission, verb))
+		}
+	}
+	return report
+}
+
+func (r *KubernetesReconciler) checkVersion() error {
+	version, err := r.clientset.Discovery().ServerVersion()
+	if err != nil {
+		return fmt.Errorf("could not get server version: %w", err)
+	}
+
+	major, err := strconv.Atoi(version.Major)
+	if err != nil {
+		return fmt.Errorf("could not parse server version %s: %w", version.GitVersion, err)
+	}
+	minor, err := strconv.Atoi(strings.TrimSuffix(version.Minor, "+")) // some providers report minors like "19+"
+	if err != nil {
+		return fmt.Errorf("could not parse server version %s: %w", version.GitVersion, err)
+	}
+
+	if major < 1 || (major == 1 && minor < minimumKubernetesMinor) {
+		return fmt.Errorf("server version %s.%s is older than 1.%d", version.Major, version.Minor, minimumKubernetesMinor)
+	}
+	return nil
+}
+
+func (r *KubernetesReconciler) checkResources(groupVersion string, names []string) error {
+	resources, err := r.clientset.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return fmt.Errorf("group version is not served: %w", err)
+	}
+
+	served := make(map[string]bool)
+	for _, resource := range resources.APIResources {
+		served[resource.Name] = true
+	}
+	missing := make([]string, 0)
+	for _, name := range names {
+		if !served[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("resources not served: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (r *KubernetesReconciler) checkPermission(ctx context.Context, permission permission, verb string) error {
+	namespace := ""
+	if !permission.clusterScoped {
+		namespace = watchedNamespace()
+	}
+
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     permission.group,
+				Resource:  permission.resource,
+			},
+		},
+	}
+	review, err := r.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not review access: %w", err)
+	}
+
+	if !review.Status.Allowed {
+		scope := "cluster wide"
+		if namespace != "" {
+			scope = "in namespace " + namespace
+		}
+		if review.Status.Reason != "" {
+			return fmt.Errorf("not allowed %s: %s", scope, review.Status.Reason)
+		}
+		return fmt.Errorf("not allowed %s", scope)
+	}
+	return nil
+}
+
+// checkPreflight fails if the manager cannot work in the cluster
+func (r *KubernetesReconciler) checkPreflight(ctx context.Context) error {
+	report := r.Preflight(ctx)
+	if report.Failed() {
+		return fmt.Errorf("preflight failed, the service manager cannot work with this cluster:\n%s", report)
+	}
+	logger.Infow("preflight passed", "cluster", r.cluster, "mode", config.GlobalConfig().NamespaceMode)
+	return nil
+}
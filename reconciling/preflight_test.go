@@ -0,0 +1,73 @@
+package reconciling
+
+import (
+	"context"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakeDiscovery "k8s.io/client-go/discovery/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	"strings"
+	"testing"
+)
+
+// serveCluster makes the fake cluster report a version and all required API resources.
+// Access reviews for the denied resources are rejected.
+func (environment *testEnvironment) serveCluster(minor string, denied ...string) {
+	discovery := environment.clientset.Discovery().(*fakeDiscovery.FakeDiscovery)
+	discovery.FakedServerVersion = &version.Info{Major: "1", Minor: minor, GitVersion: "v1." + minor}
+	for groupVersion, names := range requiredResources {
+		list := &metav1.APIResourceList{GroupVersion: groupVersion}
+		for _, name := range names {
+			list.APIResources = append(list.APIResources, metav1.APIResource{Name: name})
+		}
+		discovery.Resources = append(discovery.Resources, list)
+	}
+
+	environment.clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8sTesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		for _, resource := range denied {
+			if review.Spec.ResourceAttributes.Resource == resource {
+				review.Status.Allowed = false
+			}
+		}
+		return true, review, nil
+	})
+}
+
+func TestPreflightPasses(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	environment.serveCluster("19+")
+
+	report := environment.reconciler.Preflight(context.Background())
+	if report.Failed() {
+		t.Errorf("expected preflight to pass:\n%s", report)
+	}
+}
+
+func TestPreflightReportsMissingPermissions(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	environment.serveCluster("19", "secrets")
+
+	report := environment.reconciler.Preflight(context.Background())
+	if !report.Failed() {
+		t.Fatalf("expected preflight to fail")
+	}
+	for _, check := range report.Checks {
+		if !check.OK && !strings.Contains(check.Name, "secrets") {
+			t.Errorf("unexpected failed check %s: %s", check.Name, check.Message)
+		}
+	}
+}
+
+func TestPreflightRejectsOldClusters(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	environment.serveCluster("15")
+
+	report := environment.reconciler.Preflight(context.Background())
+	if !report.Failed() || !strings.Contains(report.String(), "older than 1.16") {
+		t.Errorf("expected an old cluster to fail the preflight:\n%s", report)
+	}
+}
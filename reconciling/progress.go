@@ -0,0 +1,129 @@
+package reconciling
+
+import (
+	"context"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math"
+)
+
+const (
+	goodRevisionAnnotation   = labelPrefix + "good-revision"
+	failedRevisionAnnotation = labelPrefix + "failed-revision"
+)
+
+// preservedAnnotations hold rollout state and are carried over when a deployment is re-rendered
+var preservedAnnotations = []string{goodRevisionAnnotation, failedRevisionAnnotation}
+
+func preserveAnnotations(deployment *appsv1.Deployment, live *appsv1.Deployment) {
+	if live == nil {
+		return
+	}
+	for _, annotation := range preservedAnnotations {
+		if value, ok := live.Annotations[annotation]; ok {
+			deployment.Annotations[annotation] = value
+		}
+	}
+}
+
+// trackProgress checks all stable deployments that have not finished rolling out their current revision
+func (r *KubernetesReconciler) trackProgress(ctx context.Context) error {
+	deployments, err := r.clientset.AppsV1().Deployments(watchedNamespace()).List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s,%s!=%s", typeLabel, typeLabelService, trackLabel, trackCanary)})
+	if err != nil {
+		return err
+	}
+
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		revision := deployment.Annotations[revisionAnnotation]
+		if revision == deployment.Annotations[goodRevisionAnnotation] || revision == deployment.Annotations[failedRevisionAnnotation] {
+			continue // rollout already finished
+		}
+
+		name := &protoStorage.NamespacedName{}
+		name.Namespace, name.Name = owner(deployment)
+		err = r.checkProgress(ctx, name, deployment)
+		if err != nil {
+			logger.Warnw("could not check rollout progress", "err", err, "namespacedName", name)
+		}
+	}
+
+	return nil
+}
+
+func (r *KubernetesReconciler) checkProgress(ctx context.Context, name *protoStorage.NamespacedName, deployment *appsv1.Deployment) error {
+	revision := deployment.Annotations[revisionAnnotation]
+
+	if isDeploymentReady(deployment) {
+		logger.Infow("rollout finished", "namespacedName", name, "revision", revision)
+		return r.markRevision(ctx, deployment, goodRevisionAnnotation, revision)
+	}
+
+	if !progressDeadlineExceeded(deployment) {
+		pods, err := r.clientset.CoreV1().Pods(deployment.Namespace).List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s,%s=%s,%s=%s,%s!=%s", namespaceLabel, labelValue(name.Namespace), nameLabel, labelValue(name.Name), typeLabel, typeLabelService, trackLabel, trackCanary)})
+		if err != nil {
+			return err
+		}
+		// Restarts alone do not fail a rollout, kubernetes decides on that with the progress deadline
+		if reason := unhealthyReason(pods.Items, math.MaxInt32); reason != "" {
+			r.statuses.set(name.Namespace, name.Name, StatusProgressing, reason)
+		}
+		return nil
+	}
+
+	message := fmt.Sprintf("rollout of revision %s did not progress within the deadline", revision)
+	logger.Warnw("rollout failed", "namespacedName", name, "revision", revision)
+	r.statuses.set(name.Namespace, name.Name, StatusFailed, message)
+	r.recordEvent(ctx, deployment, corev1.EventTypeWarning, "RolloutFailed", message)
+
+	err := r.markRevision(ctx, deployment, failedRevisionAnnotation, revision)
+	if err != nil {
+		return err
+	}
+
+	goodRevision := deployment.Annotations[goodRevisionAnnotation]
+	if !config.GlobalPolicies().Rollout(name.Namespace, name.Name).AutoRollback || goodRevision == "" {
+		return nil
+	}
+
+	r.recordEvent(ctx, deployment, corev1.EventTypeNormal, "RollingBack", fmt.Sprintf("rolling back to revision %s", goodRevision))
+	return r.rollback(ctx, name.Namespace, name.Name, goodRevision)
+}
+
+// rolloutStatus derives the status of a service from the rollout state of its rendered deployment
+func rolloutStatus(deployment *appsv1.Deployment) (string, string) {
+	revision := deployment.Annotations[revisionAnnotation]
+	switch revision {
+	case deployment.Annotations[goodRevisionAnnotation]:
+		return StatusDeployed, ""
+	case deployment.Annotations[failedRevisionAnnotation]:
+		return StatusFailed, fmt.Sprintf("rollout of revision %s failed", revision)
+	default:
+		return StatusProgressing, ""
+	}
+}
+
+func (r *KubernetesReconciler) markRevision(ctx context.Context, deployment *appsv1.Deployment, annotation string, revision string) error {
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string)
+	}
+	deployment.Annotations[annotation] = revision
+	_, err := r.clientset.AppsV1().Deployments(deployment.Namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+	return err
+}
+
+func progressDeadlineExceeded(deployment *appsv1.Deployment) bool {
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return false
+	}
+	for _, cond := range deployment.Status.Conditions {
+		if cond.Type == appsv1.DeploymentProgressing {
+			return cond.Status == corev1.ConditionFalse && cond.Reason == "ProgressDeadlineExceeded"
+		}
+	}
+	return false
+}
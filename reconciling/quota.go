@@ -0,0 +1,134 @@
+package reconciling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kulycloud/service-manager-k8s/config"
+	corev1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const quotaName = "kuly-quota"
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// quotaTracker sums up the services admitted during a single reconcile of a namespace.
+// Load balancer replicas are not counted, they are part of the platform and not of the service. In separate
+// namespaces their compute resources still count against the ResourceQuota.
+type quotaTracker struct {
+	quota    *config.Quota
+	services int32
+	replicas int32
+	cpu      resource.Quantity
+	memory   resource.Quantity
+}
+
+func newQuotaTracker(quota *config.Quota) *quotaTracker {
+	return &quotaTracker{quota: quota}
+}
+
+// admit accounts for a service running the given replicas if it fits into the remaining quota
+func (tracker *quotaTracker) admit(serviceReplicas uint32) error {
+	if tracker.quota == nil {
+		return nil
+	}
+
+	services := tracker.services + 1
+	replicas := tracker.replicas + int32(serviceReplicas)
+	if tracker.quota.MaxServices > 0 && services > tracker.quota.MaxServices {
+		return fmt.Errorf("%w: namespace may contain at most %d services", ErrQuotaExceeded, tracker.quota.MaxServices)
+	}
+	if tracker.quota.MaxReplicas > 0 && replicas > tracker.quota.MaxReplicas {
+		return fmt.Errorf("%w: namespace may run at most %d replicas, %d requested", ErrQuotaExceeded, tracker.quota.MaxReplicas, replicas)
+	}
+
+	// Compute resources are enforced by the ResourceQuota if namespaces are separate. In a shared namespace the
+	// service containers request the defaults, see defaultRequests.
+	cpu := tracker.cpu.DeepCopy()
+	memory := tracker.memory.DeepCopy()
+	if !separateNamespaces() {
+		if tracker.quota.CPU != "" {
+			cpu.Add(multiplyQuantity(tracker.quota.DefaultCPU, serviceReplicas))
+			if cpu.Cmp(resource.MustParse(tracker.quota.CPU)) > 0 {
+				return fmt.Errorf("%w: namespace may request at most %s cpu, %s requested", ErrQuotaExceeded, tracker.quota.CPU, cpu.String())
+			}
+		}
+		if tracker.quota.Memory != "" {
+			memory.Add(multiplyQuantity(tracker.quota.DefaultMemory, serviceReplicas))
+			if memory.Cmp(resource.MustParse(tracker.quota.Memory)) > 0 {
+				return fmt.Errorf("%w: namespace may request at most %s memory, %s requested", ErrQuotaExceeded, tracker.quota.Memory, memory.String())
+			}
+		}
+	}
+
+	tracker.services = services
+	tracker.replicas = replicas
+	tracker.cpu = cpu
+	tracker.memory = memory
+	return nil
+}
+
+// defaultRequests are the compute resources a service container requests if it does not set its own
+func defaultRequests(quota *config.Quota) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	if quota.DefaultCPU != "" {
+		requests[corev1.ResourceCPU] = resource.MustParse(quota.DefaultCPU)
+	}
+	if quota.DefaultMemory != "" {
+		requests[corev1.ResourceMemory] = resource.MustParse(quota.DefaultMemory)
+	}
+	return requests
+}
+
+func multiplyQuantity(value string, factor uint32) resource.Quantity {
+	quantity := resource.MustParse(value)
+	return *resource.NewMilliQuantity(quantity.MilliValue()*int64(factor), quantity.Format)
+}
+
+// reconcileQuota renders the quota of a namespace as ResourceQuota and LimitRange if namespaces are separate
+func (r *KubernetesReconciler) reconcileQuota(ctx context.Context, namespace string) error {
+	if !separateNamespaces() {
+		return nil
+	}
+
+	quota := config.GlobalPolicies().Namespace(namespace).Quota
+	quotasClient := r.clientset.CoreV1().ResourceQuotas(targetNamespace(namespace))
+	limitRangesClient := r.clientset.CoreV1().LimitRanges(targetNamespace(namespace))
+
+	if quota == nil || (quota.CPU == "" && quota.Memory == "") {
+		err := quotasClient.Delete(ctx, quotaName, metav1.DeleteOptions{})
+		if err != nil && !apiErrors.IsNotFound(err) {
+			return fmt.Errorf("could not delete ResourceQuota: %w", err)
+		}
+	} else {
+		resourceQuota := buildResourceQuota(namespace, quota)
+		_, err := quotasClient.Update(ctx, resourceQuota, metav1.UpdateOptions{})
+		if apiErrors.IsNotFound(err) {
+			_, err = quotasClient.Create(ctx, resourceQuota, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("could not update/create ResourceQuota: %w", err)
+		}
+	}
+
+	if quota == nil || (quota.DefaultCPU == "" && quota.DefaultMemory == "") {
+		err := limitRangesClient.Delete(ctx, quotaName, metav1.DeleteOptions{})
+		if err != nil && !apiErrors.IsNotFound(err) {
+			return fmt.Errorf("could not delete LimitRange: %w", err)
+		}
+	} else {
+		limitRange := buildLimitRange(namespace, quota)
+		_, err := limitRangesClient.Update(ctx, limitRange, metav1.UpdateOptions{})
+		if apiErrors.IsNotFound(err) {
+			_, err = limitRangesClient.Create(ctx, limitRange, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("could not update/create LimitRange: %w", err)
+		}
+	}
+
+	return nil
+}
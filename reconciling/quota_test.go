@@ -0,0 +1,39 @@
+package reconciling
+
+import (
+	"context"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestSharedNamespaceServicesRequestDefaults(t *testing.T) {
+	environment := newTestEnvironment(t, 12270)
+	config.GlobalPolicies().Defaults.Quota = &config.Quota{CPU: "1", DefaultCPU: "500m", DefaultMemory: "64Mi"}
+	ctx := context.Background()
+	name := &protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}
+	_ = environment.storage.SetService(ctx, testNamespace, "web", &protoStorage.Service{Image: "nginx", Replicas: 2})
+	environment.reconcile(t)
+
+	deployment, err := environment.clientset.AppsV1().Deployments(targetNamespace(testNamespace)).Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get service deployment: %v", err)
+	}
+	requests := deployment.Spec.Template.Spec.Containers[0].Resources.Requests
+	if cpu := requests[corev1.ResourceCPU]; cpu.String() != "500m" {
+		t.Errorf("expected a cpu request of 500m, got %s", cpu.String())
+	}
+	if memory := requests[corev1.ResourceMemory]; memory.String() != "64Mi" {
+		t.Errorf("expected a memory request of 64Mi, got %s", memory.String())
+	}
+
+	// web already requests the whole cpu quota
+	_ = environment.storage.SetService(ctx, testNamespace, "api", &protoStorage.Service{Image: "nginx", Replicas: 1})
+	environment.reconcile(t)
+	status, _ := environment.reconciler.statuses.get(testNamespace, "api")
+	if status.Phase != StatusQuotaExceeded {
+		t.Errorf("expected api to exceed the quota, got %s", status.Phase)
+	}
+}
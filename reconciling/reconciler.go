@@ -16,58 +16,119 @@ import (
 )
 
 const (
-	labelPrefix      = "platform.kuly.cloud/"
-	namespaceLabel   = labelPrefix + "namespace"
-	typeLabel        = labelPrefix + "type"
-	typeLabelService = "service"
-	typeLabelLB      = "loadbalancer"
-	nameLabel 		 = labelPrefix + "name"
+	labelPrefix         = "platform.kuly.cloud/"
+	namespaceLabel      = labelPrefix + "namespace"
+	typeLabel           = labelPrefix + "type"
+	typeLabelService    = "service"
+	typeLabelLB         = "loadbalancer"
+	typeLabelNamespace  = "namespace"
+	typeLabelHistory    = "history"
+	typeLabelPullSecret = "pullsecret"
+	typeLabelQuota      = "quota"
+	nameLabel           = labelPrefix + "name"
+	// deploymentLabel selects the pods of a single deployment, so the selectors of a service's deployments do not overlap
+	deploymentLabel = labelPrefix + "deployment"
 )
 
 var logger = logging.GetForComponent("reconciler")
 
 type Reconciler interface {
+	CheckAndSetup(ctx context.Context) error
+	Preflight(ctx context.Context) *PreflightReport
 	ReconcileDeployments(ctx context.Context, namespace string) error
+	ReconcileService(ctx context.Context, namespace string, name string) error
+	ConfirmDeletion(ctx context.Context, namespace string) error
+	ResyncLoadBalancers(ctx context.Context, namespace string) error
+	ReconcileNamespaces(ctx context.Context, namespaces []string) error
+	ReconcileRollouts(ctx context.Context) error
 	PropagateStorageToLoadBalancers(ctx context.Context, endpoints []*protoCommon.Endpoint)
+	Freeze(reason string)
+	Thaw(ctx context.Context) error
+	Frozen() bool
 	MonitorCluster(ctx context.Context) error
 }
 
 var _ Reconciler = &KubernetesReconciler{}
 
+// KubernetesReconciler manages the services placed in a single cluster
 type KubernetesReconciler struct {
-	storage *commonCommunication.StorageCommunicator
-	clientset *kubernetes.Clientset
+	storage   Storage
+	clientset kubernetes.Interface
+	cache     *clusterCache
+	statuses  *statusStore
+	deletions *deletionGuard
+	freeze    *freezeState
+	// cluster is the name of the cluster in a multi cluster setup and empty otherwise
+	cluster   string
+	endpoints *endpointAggregator
+	pushed    *pushedEndpoints
+	drifts    *driftReports
+}
+
+// NewReconciler creates a reconciler for the configured clusters
+func NewReconciler(storage *commonCommunication.StorageCommunicator) (Reconciler, error) {
+	if len(config.GlobalConfig().ClusterNames()) > 0 {
+		return NewMultiClusterReconciler(storage)
+	}
+	return NewKubernetesReconciler(storage)
 }
 
 func NewKubernetesReconciler(storage *commonCommunication.StorageCommunicator) (*KubernetesReconciler, error) {
 	var configObj *rest.Config
 	var err error
 
-	if config.GlobalConfig.Kubeconfig == "" {
+	if config.GlobalConfig().Kubeconfig == "" {
 		logger.Info("using in-cluster configuration for kubernetes")
 		configObj, err = rest.InClusterConfig()
 	} else {
 		logger.Info("using provided kubeconfig")
-		configObj, err = clientcmd.BuildConfigFromFlags("", config.GlobalConfig.Kubeconfig)
+		configObj, err = clientcmd.BuildConfigFromFlags("", config.GlobalConfig().Kubeconfig)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config: %w", err)
 	}
 
+	return newKubernetesReconcilerForConfig(&communicatorStorage{storage}, configObj, "")
+}
+
+func newKubernetesReconcilerForConfig(storage Storage, configObj *rest.Config, cluster string) (*KubernetesReconciler, error) {
 	clientset, err := kubernetes.NewForConfig(configObj)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config: %w", err)
 	}
 
+	return NewKubernetesReconcilerWithClient(storage, clientset, cluster), nil
+}
+
+// NewKubernetesReconcilerWithClient creates a reconciler on top of an existing client, e.g. a fake one in tests.
+// The cluster name is empty unless the reconciler is part of a multi cluster setup.
+func NewKubernetesReconcilerWithClient(storage Storage, clientset kubernetes.Interface, cluster string) *KubernetesReconciler {
 	return &KubernetesReconciler{
-		storage: storage,
+		storage:   storage,
 		clientset: clientset,
-	}, nil
+		cache:     newClusterCache(clientset),
+		statuses:  newStatusStore(),
+		deletions: newDeletionGuard(),
+		freeze:    newFreezeState(),
+		cluster:   cluster,
+		endpoints: newEndpointAggregator(storage),
+		pushed:    newPushedEndpoints(),
+		drifts:    newDriftReports(),
+	}
 }
 
 func (r *KubernetesReconciler) CheckAndSetup(ctx context.Context) error {
-	_, err := r.clientset.CoreV1().Namespaces().Get(ctx, config.GlobalConfig.ServiceNamespace, metav1.GetOptions{})
+	err := r.checkPreflight(ctx)
+	if err != nil {
+		return err
+	}
+
+	if separateNamespaces() {
+		return nil // namespaces are created on demand
+	}
+
+	_, err = r.clientset.CoreV1().Namespaces().Get(ctx, config.GlobalConfig().ServiceNamespace, metav1.GetOptions{})
 	if err != nil {
 		if apiErrors.IsNotFound(err) {
 			return r.createNamespace(ctx)
@@ -81,7 +142,7 @@ func (r *KubernetesReconciler) createNamespace(ctx context.Context) error {
 	logger.Info("creating namespace")
 	_, err := r.clientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: config.GlobalConfig.ServiceNamespace,
+			Name: config.GlobalConfig().ServiceNamespace,
 		},
 	}, metav1.CreateOptions{})
 
@@ -0,0 +1,93 @@
+package reconciling
+
+import (
+	"bytes"
+	"fmt"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"google.golang.org/protobuf/encoding/protojson"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+var deploymentType = metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"}
+
+// Render returns the resources the manager creates for a service, in the order they are created.
+// State that only exists in a cluster, like rollout progress or scale overrides, is not included.
+func Render(name *protoStorage.NamespacedName, service *protoStorage.Service) ([]runtime.Object, error) {
+	objects := make([]runtime.Object, 0)
+
+	if separateNamespaces() {
+		namespace := buildNamespace(name.Namespace)
+		namespace.TypeMeta = metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Namespace"}
+		objects = append(objects, namespace)
+
+		quota := config.GlobalPolicies().Namespace(name.Namespace).Quota
+		if quota != nil && (quota.CPU != "" || quota.Memory != "") {
+			resourceQuota := buildResourceQuota(name.Namespace, quota)
+			resourceQuota.TypeMeta = metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "ResourceQuota"}
+			objects = append(objects, resourceQuota)
+		}
+		if quota != nil && (quota.DefaultCPU != "" || quota.DefaultMemory != "") {
+			limitRange := buildLimitRange(name.Namespace, quota)
+			limitRange.TypeMeta = metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "LimitRange"}
+			objects = append(objects, limitRange)
+		}
+	}
+
+	if service.PullSecrets != "" {
+		pullSecrets := buildPullSecrets(name, service)
+		pullSecrets.TypeMeta = metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"}
+		objects = append(objects, pullSecrets)
+	}
+
+	deployment, err := applyOverlays(buildDeploymentFromService(name, service), config.GlobalPolicies().Overlays(name.Namespace, name.Name))
+	if err != nil {
+		return nil, err
+	}
+	deployment.TypeMeta = deploymentType
+	objects = append(objects, deployment)
+
+	loadbalancer := buildLoadBalancerDeploymentFromService(name, service)
+	loadbalancer.TypeMeta = deploymentType
+	objects = append(objects, loadbalancer)
+
+	return objects, nil
+}
+
+// ParseServiceDefinition reads a service in the JSON or YAML form of its storage message
+func ParseServiceDefinition(data []byte) (*protoStorage.Service, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse service definition: %w", err)
+	}
+
+	service := &protoStorage.Service{}
+	err = protojson.Unmarshal(jsonData, service)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse service definition: %w", err)
+	}
+	return service, nil
+}
+
+// RenderYAML returns the rendered resources of a service as a multi document YAML stream
+func RenderYAML(name *protoStorage.NamespacedName, service *protoStorage.Service) ([]byte, error) {
+	objects, err := Render(name, service)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.Buffer{}
+	for _, object := range objects {
+		document, err := yaml.Marshal(object)
+		if err != nil {
+			return nil, err
+		}
+		buffer.WriteString("---\n")
+		buffer.Write(document)
+	}
+	return buffer.Bytes(), nil
+}
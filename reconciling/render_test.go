@@ -0,0 +1,76 @@
+package reconciling
+
+import (
+	"bytes"
+	"flag"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the render tests")
+
+func TestRenderGolden(t *testing.T) {
+	cases := []struct {
+		name     string
+		separate bool
+	}{
+		{name: "basic"},
+		{name: "pull-secrets"},
+		{name: "separate-namespace", separate: true},
+		{name: "policies"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			newTestEnvironment(t, 12270)
+			directory := filepath.Join("testdata", "render", c.name)
+			if c.separate {
+				config.GlobalConfig().NamespaceMode = config.NamespaceModeSeparate
+				config.GlobalConfig().NamespaceNameTemplate = "kuly-{namespace}"
+			}
+
+			policyFile := filepath.Join(directory, "policies.yaml")
+			if _, err := os.Stat(policyFile); err == nil {
+				policies, err := config.LoadPolicies(policyFile)
+				if err != nil {
+					t.Fatalf("could not load policies: %v", err)
+				}
+				config.SetGlobal(config.GlobalConfig(), policies)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(directory, "service.yaml"))
+			if err != nil {
+				t.Fatalf("could not read service definition: %v", err)
+			}
+			service, err := ParseServiceDefinition(data)
+			if err != nil {
+				t.Fatalf("could not parse service definition: %v", err)
+			}
+
+			rendered, err := RenderYAML(&protoStorage.NamespacedName{Namespace: testNamespace, Name: "web"}, service)
+			if err != nil {
+				t.Fatalf("could not render: %v", err)
+			}
+
+			golden := filepath.Join(directory, "expected.yaml")
+			if *update {
+				err = ioutil.WriteFile(golden, rendered, 0644)
+				if err != nil {
+					t.Fatalf("could not update golden file: %v", err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("could not read golden file: %v", err)
+			}
+			if !bytes.Equal(rendered, expected) {
+				t.Errorf("rendered manifests differ from %s, run the tests with -update if the change is intended\n%s", golden, rendered)
+			}
+		})
+	}
+}
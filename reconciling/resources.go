@@ -4,86 +4,211 @@ import (
 	"fmt"
 	protoStorage "github.com/kulycloud/protocol/storage"
 	"github.com/kulycloud/service-manager-k8s/config"
+	"sort"
 	"strconv"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	defaultLoadBalancerReplicas int32 = 2
+	serviceContainerName              = "app-container"
+)
+
 func serviceDeploymentName(name *protoStorage.NamespacedName) string {
-	return fmt.Sprintf("svc-%s-%s", name.Namespace, name.Name)
+	return resourceName("svc", name, "")
 }
 
 func serviceLBDeploymentName(name *protoStorage.NamespacedName) string {
-	return fmt.Sprintf("svclb-%s-%s", name.Namespace, name.Name)
+	return resourceName("svclb", name, "")
+}
+
+func canaryDeploymentName(name *protoStorage.NamespacedName) string {
+	return resourceName("svc", name, "canary")
+}
+
+func historySecretName(name *protoStorage.NamespacedName) string {
+	return resourceName("svc", name, "history")
 }
 
 func pullSecretName(name *protoStorage.NamespacedName) string {
-	return fmt.Sprintf("svc-%s-%s-pullsecret", name.Namespace, name.Name)
+	return resourceName("svc", name, "pullsecret")
+}
+
+func buildNamespace(namespace string) *corev1.Namespace {
+	kubernetesNamespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: targetNamespace(namespace),
+			Labels: map[string]string{
+				namespaceLabel: labelValue(namespace),
+				typeLabel:      typeLabelNamespace,
+			},
+		},
+	}
+	annotateOwner(&kubernetesNamespace.ObjectMeta, namespace, "")
+	return kubernetesNamespace
+}
+
+func buildResourceQuota(namespace string, quota *config.Quota) *corev1.ResourceQuota {
+	hard := corev1.ResourceList{}
+	if quota.CPU != "" {
+		hard[corev1.ResourceRequestsCPU] = resource.MustParse(quota.CPU)
+	}
+	if quota.Memory != "" {
+		hard[corev1.ResourceRequestsMemory] = resource.MustParse(quota.Memory)
+	}
+
+	resourceQuota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      quotaName,
+			Namespace: targetNamespace(namespace),
+			Labels: map[string]string{
+				namespaceLabel: labelValue(namespace),
+				typeLabel:      typeLabelQuota,
+			},
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: hard,
+		},
+	}
+	annotateOwner(&resourceQuota.ObjectMeta, namespace, "")
+	return resourceQuota
+}
+
+func buildLimitRange(namespace string, quota *config.Quota) *corev1.LimitRange {
+	limitRange := &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      quotaName,
+			Namespace: targetNamespace(namespace),
+			Labels: map[string]string{
+				namespaceLabel: labelValue(namespace),
+				typeLabel:      typeLabelQuota,
+			},
+		},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{
+				{
+					Type:           corev1.LimitTypeContainer,
+					DefaultRequest: defaultRequests(quota),
+				},
+			},
+		},
+	}
+	annotateOwner(&limitRange.ObjectMeta, namespace, "")
+	return limitRange
+}
+
+func buildHistorySecret(name *protoStorage.NamespacedName, history []byte) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      historySecretName(name),
+			Namespace: targetNamespace(name.Namespace),
+			Labels: map[string]string{
+				namespaceLabel: labelValue(name.Namespace),
+				typeLabel:      typeLabelHistory,
+				nameLabel:      labelValue(name.Name),
+			},
+			Annotations: map[string]string{
+				managedByAnnotation: eventSource,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			historyDataKey: history,
+		},
+	}
+	annotateOwner(&secret.ObjectMeta, name.Namespace, name.Name)
+	return secret
 }
 
 func buildPullSecrets(name *protoStorage.NamespacedName, service *protoStorage.Service) *corev1.Secret {
 	data := []byte(service.PullSecrets)
-	return &corev1.Secret{
+	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      pullSecretName(name),
-			Namespace: config.GlobalConfig.ServiceNamespace,
+			Namespace: targetNamespace(name.Namespace),
+			Labels: map[string]string{
+				namespaceLabel: labelValue(name.Namespace),
+				typeLabel:      typeLabelPullSecret,
+				nameLabel:      labelValue(name.Name),
+			},
+			Annotations: map[string]string{
+				managedByAnnotation: eventSource,
+			},
 		},
 		Type: "kubernetes.io/dockerconfigjson",
 		Data: map[string][]byte{
 			".dockerconfigjson": data,
 		},
 	}
+	annotateOwner(&secret.ObjectMeta, name.Namespace, name.Name)
+	return secret
 }
 
 func buildDeploymentFromService(name *protoStorage.NamespacedName, service *protoStorage.Service) *appsv1.Deployment {
-	envVars := make([]corev1.EnvVar, 0)
-	for name, value := range service.Environment {
+	// sorted so the pod template does not change between reconciles
+	envNames := make([]string, 0, len(service.Environment))
+	for envName := range service.Environment {
+		envNames = append(envNames, envName)
+	}
+	sort.Strings(envNames)
+	envVars := make([]corev1.EnvVar, 0, len(envNames))
+	for _, envName := range envNames {
 		envVars = append(envVars, corev1.EnvVar{
-			Name:  name,
-			Value: value,
+			Name:  envName,
+			Value: service.Environment[envName],
 		})
 	}
 	replicas := int32(service.Replicas)
+	progressDeadline := int32(config.GlobalPolicies().Rollout(name.Namespace, name.Name).ProgressDeadline.Seconds())
 
 	deployment := appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      serviceDeploymentName(name),
-			Namespace: config.GlobalConfig.ServiceNamespace,
+			Namespace: targetNamespace(name.Namespace),
 			Labels: map[string]string{
-				namespaceLabel: name.Namespace,
+				namespaceLabel: labelValue(name.Namespace),
 				typeLabel:      typeLabelService,
-				nameLabel:      name.Name,
+				nameLabel:      labelValue(name.Name),
+			},
+			Annotations: map[string]string{
+				revisionAnnotation:  serviceRevision(service),
+				managedByAnnotation: eventSource,
 			},
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &replicas,
+			Replicas:                &replicas,
+			ProgressDeadlineSeconds: &progressDeadline,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
-					namespaceLabel: name.Namespace,
-					typeLabel:      typeLabelService,
-					nameLabel:      name.Name,
+					namespaceLabel:  labelValue(name.Namespace),
+					typeLabel:       typeLabelService,
+					nameLabel:       labelValue(name.Name),
+					deploymentLabel: serviceDeploymentName(name),
 				},
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
-						namespaceLabel: name.Namespace,
-						typeLabel:      typeLabelService,
-						nameLabel:      name.Name,
+						namespaceLabel:  labelValue(name.Namespace),
+						typeLabel:       typeLabelService,
+						nameLabel:       labelValue(name.Name),
+						deploymentLabel: serviceDeploymentName(name),
 					},
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
-							Name:  "app-container",
+							Name:  serviceContainerName,
 							Image: service.Image,
 							Args:  service.Arguments,
 							Ports: []corev1.ContainerPort{
 								{
 									Name:          "http-port",
-									ContainerPort: int32(config.GlobalConfig.HTTPPort),
+									ContainerPort: int32(config.GlobalConfig().HTTPPort),
 								},
 							},
 							Env: envVars,
@@ -97,73 +222,152 @@ func buildDeploymentFromService(name *protoStorage.NamespacedName, service *prot
 	if service.PullSecrets != "" {
 		deployment.Spec.Template.Spec.ImagePullSecrets = []corev1.LocalObjectReference{
 			{
-				Name: fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", config.GlobalConfig.ServiceNamespace, pullSecretName(name)),
+				Name: fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", targetNamespace(name.Namespace), pullSecretName(name)),
 			},
 		}
 	}
 
+	// separate namespaces get the defaults from their LimitRange, a shared namespace has none
+	if quota := config.GlobalPolicies().Namespace(name.Namespace).Quota; quota != nil && !separateNamespaces() {
+		deployment.Spec.Template.Spec.Containers[0].Resources.Requests = defaultRequests(quota)
+	}
+
+	annotateOwner(&deployment.ObjectMeta, name.Namespace, name.Name)
+	annotateOwner(&deployment.Spec.Template.ObjectMeta, name.Namespace, name.Name)
 	return &deployment
 }
 
-func buildLoadBalancerDeploymentFromService(name *protoStorage.NamespacedName, _ *protoStorage.Service) *appsv1.Deployment {
-	var replicas int32 = 2
-	return &appsv1.Deployment{
+// loadBalancerReplicas calculates the replica count of the load balancer of a service
+func loadBalancerReplicas(policy *config.LoadBalancerPolicy, service *protoStorage.Service) int32 {
+	if policy.Autoscale == nil {
+		if policy.Replicas != nil {
+			return *policy.Replicas
+		}
+		return defaultLoadBalancerReplicas
+	}
+
+	autoscale := policy.Autoscale
+	perLoadBalancer := uint32(autoscale.ServiceReplicasPerLoadBalancer)
+	replicas := int32((service.Replicas + perLoadBalancer - 1) / perLoadBalancer)
+
+	minReplicas := autoscale.MinReplicas
+	if minReplicas < 1 {
+		minReplicas = 1
+	}
+	if replicas < minReplicas {
+		replicas = minReplicas
+	}
+	if autoscale.MaxReplicas > 0 && replicas > autoscale.MaxReplicas {
+		replicas = autoscale.MaxReplicas
+	}
+	return replicas
+}
+
+func buildCanaryDeploymentFromService(name *protoStorage.NamespacedName, service *protoStorage.Service, replicas int32) *appsv1.Deployment {
+	deployment := buildDeploymentFromService(name, service)
+	deployment.Name = canaryDeploymentName(name)
+	deployment.Spec.Replicas = &replicas
+	deployment.Labels[trackLabel] = trackCanary
+	deployment.Spec.Selector.MatchLabels[trackLabel] = trackCanary
+	deployment.Spec.Template.Labels[trackLabel] = trackCanary
+	deployment.Spec.Selector.MatchLabels[deploymentLabel] = deployment.Name
+	deployment.Spec.Template.Labels[deploymentLabel] = deployment.Name
+	return deployment
+}
+
+func buildLoadBalancerDeploymentFromService(name *protoStorage.NamespacedName, service *protoStorage.Service) *appsv1.Deployment {
+	policy := config.GlobalPolicies().LoadBalancer(name.Namespace, name.Name)
+	replicas := loadBalancerReplicas(&policy, service)
+
+	image := config.GlobalConfig().LoadBalancerImage
+	if policy.Image != "" {
+		image = policy.Image
+	}
+
+	resources := corev1.ResourceRequirements{}
+	if policy.Resources != nil {
+		resources = *policy.Resources
+	}
+
+	envVars := []corev1.EnvVar{
+		{
+			Name: "PORT",
+			Value: strconv.FormatInt(int64(config.GlobalConfig().LoadBalancerControlPort), 10),
+		},
+		{
+			Name: "HTTP_PORT",
+			Value: strconv.FormatInt(int64(config.GlobalConfig().HTTPPort), 10),
+		},
+	}
+	envNames := make([]string, 0, len(policy.Environment))
+	for envName := range policy.Environment {
+		envNames = append(envNames, envName)
+	}
+	sort.Strings(envNames)
+	for _, envName := range envNames {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  envName,
+			Value: policy.Environment[envName],
+		})
+	}
+
+	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      serviceLBDeploymentName(name),
-			Namespace: config.GlobalConfig.ServiceNamespace,
+			Namespace: targetNamespace(name.Namespace),
 			Labels: map[string]string{
-				namespaceLabel: name.Namespace,
+				namespaceLabel: labelValue(name.Namespace),
 				typeLabel:      typeLabelLB,
-				nameLabel:      name.Name,
+				nameLabel:      labelValue(name.Name),
+			},
+			Annotations: map[string]string{
+				managedByAnnotation: eventSource,
 			},
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
-					namespaceLabel: name.Namespace,
-					typeLabel:      typeLabelLB,
-					nameLabel:      name.Name,
+					namespaceLabel:  labelValue(name.Namespace),
+					typeLabel:       typeLabelLB,
+					nameLabel:       labelValue(name.Name),
+					deploymentLabel: serviceLBDeploymentName(name),
 				},
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: map[string]string{
-						namespaceLabel: name.Namespace,
-						typeLabel:      typeLabelLB,
-						nameLabel:      name.Name,
+						namespaceLabel:  labelValue(name.Namespace),
+						typeLabel:       typeLabelLB,
+						nameLabel:       labelValue(name.Name),
+						deploymentLabel: serviceLBDeploymentName(name),
 					},
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
 							Name:            "lb-container",
-							Image:           config.GlobalConfig.LoadBalancerImage,
+							Image:           image,
 							ImagePullPolicy: corev1.PullIfNotPresent,
+							Resources:       resources,
 							Ports: []corev1.ContainerPort{
 								{
 									Name:          "http-port",
-									ContainerPort: int32(config.GlobalConfig.HTTPPort),
+									ContainerPort: int32(config.GlobalConfig().HTTPPort),
 								},
 								{
 									Name:          "control-port",
-									ContainerPort: int32(config.GlobalConfig.LoadBalancerControlPort),
-								},
-							},
-							Env: []corev1.EnvVar{
-								{
-									Name: "PORT",
-									Value: strconv.FormatInt(int64(config.GlobalConfig.LoadBalancerControlPort), 10),
-								},
-								{
-									Name: "HTTP_PORT",
-									Value: strconv.FormatInt(int64(config.GlobalConfig.HTTPPort), 10),
+									ContainerPort: int32(config.GlobalConfig().LoadBalancerControlPort),
 								},
 							},
+							Env: envVars,
 						},
 					},
 				},
 			},
 		},
 	}
+	annotateOwner(&deployment.ObjectMeta, name.Namespace, name.Name)
+	annotateOwner(&deployment.Spec.Template.ObjectMeta, name.Namespace, name.Name)
+	return deployment
 }
@@ -0,0 +1,410 @@
+package reconciling
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"time"
+)
+
+const (
+	trackLabel                = labelPrefix + "track"
+	trackCanary               = "canary"
+	revisionAnnotation        = labelPrefix + "revision"
+	canaryStepAnnotation      = labelPrefix + "canary-step"
+	canaryStepSinceAnnotation = labelPrefix + "canary-step-since"
+	canaryAbortedAnnotation   = labelPrefix + "canary-aborted-revision"
+	canaryPromotedAnnotation  = labelPrefix + "canary-promoted"
+)
+
+// maxWeightedEndpoints caps the endpoint list that is pushed to the load balancers while a canary gets traffic
+const maxWeightedEndpoints = 100
+
+// serviceRevision identifies everything that ends up in the pod template of a service
+func serviceRevision(service *protoStorage.Service) string {
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%q\n%q\n", service.Image, service.PullSecrets)
+	for _, arg := range service.Arguments {
+		_, _ = fmt.Fprintf(hash, "%q\n", arg)
+	}
+	_, _ = fmt.Fprintf(hash, "%s\n", environmentHash(service.Environment))
+
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// applyRolloutStrategy adjusts the rendered deployment of a service to its rollout strategy.
+// With the canary and blue/green strategies a new revision is first deployed as separate canary deployment
+// and the stable deployment keeps its current pod template until the canary is promoted.
+func (r *KubernetesReconciler) applyRolloutStrategy(ctx context.Context, name *protoStorage.NamespacedName, service *protoStorage.Service, deployment *appsv1.Deployment, live *appsv1.Deployment) (*appsv1.Deployment, error) {
+	policy := config.GlobalPolicies().Rollout(name.Namespace, name.Name)
+	revision := deployment.Annotations[revisionAnnotation]
+
+	if live == nil || policy.Strategy == config.RolloutStrategyRollingUpdate {
+		return deployment, r.deleteCanary(ctx, name)
+	}
+
+	if live.Annotations[revisionAnnotation] == revision {
+		// A promoted canary keeps serving until the stable deployment has rolled out
+		return deployment, r.deleteCanaryUnlessRevision(ctx, name, revision)
+	}
+
+	deployment.Spec.Template = live.Spec.Template
+	deployment.Annotations[revisionAnnotation] = live.Annotations[revisionAnnotation]
+	preserveAnnotations(deployment, live)
+
+	// An aborted revision is not retried until the service changes again
+	aborted := live.Annotations[canaryAbortedAnnotation]
+	if aborted == revision {
+		deployment.Annotations[canaryAbortedAnnotation] = aborted
+		return deployment, nil
+	}
+
+	replicas := policy.Canary.Replicas
+	if policy.Strategy == config.RolloutStrategyBlueGreen {
+		replicas = int32(service.Replicas)
+	}
+	return deployment, r.ensureCanary(ctx, name, service, replicas)
+}
+
+func (r *KubernetesReconciler) ensureCanary(ctx context.Context, name *protoStorage.NamespacedName, service *protoStorage.Service, replicas int32) error {
+	deploymentsClient := r.clientset.AppsV1().Deployments(targetNamespace(name.Namespace))
+	canary, err := applyOverlays(buildCanaryDeploymentFromService(name, service, replicas), config.GlobalPolicies().Overlays(name.Namespace, name.Name))
+	if err != nil {
+		return err
+	}
+
+	live, err := deploymentsClient.Get(ctx, canary.Name, metav1.GetOptions{})
+	if err != nil && !apiErrors.IsNotFound(err) {
+		return fmt.Errorf("could not get canary: %w", err)
+	}
+	setSpecHash(canary)
+
+	if err == nil && live.Annotations[revisionAnnotation] == canary.Annotations[revisionAnnotation] {
+		// keep the progress of the running canary
+		for _, annotation := range []string{canaryStepAnnotation, canaryStepSinceAnnotation, canaryPromotedAnnotation} {
+			if value, ok := live.Annotations[annotation]; ok {
+				canary.Annotations[annotation] = value
+			}
+		}
+		_, err = deploymentsClient.Update(ctx, canary, metav1.UpdateOptions{})
+		return err
+	}
+
+	logger.Infow("starting canary", "namespacedName", name, "revision", canary.Annotations[revisionAnnotation])
+	canary.Annotations[canaryStepAnnotation] = "0"
+	canary.Annotations[canaryStepSinceAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if apiErrors.IsNotFound(err) {
+		_, err = deploymentsClient.Create(ctx, canary, metav1.CreateOptions{})
+	} else {
+		_, err = deploymentsClient.Update(ctx, canary, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+func (r *KubernetesReconciler) deleteCanary(ctx context.Context, name *protoStorage.NamespacedName) error {
+	err := r.clientset.AppsV1().Deployments(targetNamespace(name.Namespace)).Delete(ctx, canaryDeploymentName(name), metav1.DeleteOptions{})
+	if err != nil && !apiErrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete canary: %w", err)
+	}
+	return nil
+}
+
+func (r *KubernetesReconciler) deleteCanaryUnlessRevision(ctx context.Context, name *protoStorage.NamespacedName, revision string) error {
+	canary, err := r.clientset.AppsV1().Deployments(targetNamespace(name.Namespace)).Get(ctx, canaryDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		if apiErrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("could not get canary: %w", err)
+	}
+
+	if canary.Annotations[revisionAnnotation] == revision {
+		return nil
+	}
+	return r.deleteCanary(ctx, name)
+}
+
+// ReconcileRollouts advances, promotes or aborts all running canaries and tracks the progress of all other rollouts
+func (r *KubernetesReconciler) ReconcileRollouts(ctx context.Context) error {
+	err := r.trackProgress(ctx)
+	if err != nil {
+		return err
+	}
+
+	canaries, err := r.clientset.AppsV1().Deployments(watchedNamespace()).List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", trackLabel, trackCanary)})
+	if err != nil {
+		return err
+	}
+
+	for i := range canaries.Items {
+		canary := &canaries.Items[i]
+		name := &protoStorage.NamespacedName{}
+		name.Namespace, name.Name = owner(canary)
+
+		changed, err := r.progressCanary(ctx, name, canary)
+		if err != nil {
+			logger.Warnw("could not progress canary", "err", err, "namespacedName", name)
+			continue
+		}
+
+		if changed {
+			err = r.ReconcilePods(ctx, name.Namespace, name.Name)
+			if err != nil {
+				logger.Warnw("error reconciling pods", "namespace", name.Namespace, "serviceName", name.Name, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rolloutSteps returns the number of traffic steps of a strategy and how long each step is held
+func rolloutSteps(policy *config.RolloutPolicy, step int) (int, time.Duration) {
+	if policy.Strategy == config.RolloutStrategyBlueGreen {
+		// switch as soon as all pods are ready, then keep the previous revision for the grace period
+		if step == 0 {
+			return 2, 0
+		}
+		return 2, policy.BlueGreen.GracePeriod.Duration
+	}
+	return len(policy.Canary.Steps), policy.Canary.StepInterval.Duration
+}
+
+// rolloutWeight returns the percentage of traffic sent to the canary in the given step
+func rolloutWeight(policy *config.RolloutPolicy, step int) int32 {
+	if policy.Strategy == config.RolloutStrategyBlueGreen {
+		if step == 0 {
+			return 0
+		}
+		return 100
+	}
+
+	steps := policy.Canary.Steps
+	if step < 0 {
+		return 0
+	}
+	if step >= len(steps) {
+		return steps[len(steps)-1]
+	}
+	return steps[step]
+}
+
+// progressCanary returns whether the traffic split of the service changed
+func (r *KubernetesReconciler) progressCanary(ctx context.Context, name *protoStorage.NamespacedName, canary *appsv1.Deployment) (bool, error) {
+	policy := config.GlobalPolicies().Rollout(name.Namespace, name.Name)
+
+	pods, err := r.clientset.CoreV1().Pods(canary.Namespace).List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s,%s=%s,%s=%s", namespaceLabel, labelValue(name.Namespace), nameLabel, labelValue(name.Name), trackLabel, trackCanary)})
+	if err != nil {
+		return false, err
+	}
+
+	if reason := unhealthyReason(pods.Items, policy.Canary.MaxRestarts); reason != "" {
+		return true, r.abortCanary(ctx, name, canary, reason)
+	}
+
+	if canary.Annotations[canaryPromotedAnnotation] != "" {
+		return r.finishPromotion(ctx, name, canary)
+	}
+
+	if !isDeploymentReady(canary) {
+		return false, nil // wait for canary to become ready
+	}
+
+	step, _ := strconv.Atoi(canary.Annotations[canaryStepAnnotation])
+	steps, interval := rolloutSteps(&policy, step)
+	since, err := time.Parse(time.RFC3339, canary.Annotations[canaryStepSinceAnnotation])
+	if err == nil && time.Since(since) < interval {
+		return false, nil
+	}
+
+	step++
+	if step < steps {
+		logger.Infow("advancing canary", "namespacedName", name, "weight", rolloutWeight(&policy, step))
+		canary.Annotations[canaryStepAnnotation] = strconv.Itoa(step)
+		canary.Annotations[canaryStepSinceAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		_, err = r.clientset.AppsV1().Deployments(canary.Namespace).Update(ctx, canary, metav1.UpdateOptions{})
+		return err == nil, err
+	}
+
+	return false, r.promoteCanary(ctx, name, canary)
+}
+
+func isDeploymentReady(deployment *appsv1.Deployment) bool {
+	if deployment.Spec.Replicas == nil || deployment.Status.ObservedGeneration < deployment.Generation {
+		return false
+	}
+	return deployment.Status.UpdatedReplicas == *deployment.Spec.Replicas &&
+		deployment.Status.ReadyReplicas == *deployment.Spec.Replicas &&
+		deployment.Status.Replicas == *deployment.Spec.Replicas
+}
+
+// promoteCanary moves the pod template of the canary to the stable deployment.
+// The canary keeps its share of traffic until the stable deployment has rolled out.
+func (r *KubernetesReconciler) promoteCanary(ctx context.Context, name *protoStorage.NamespacedName, canary *appsv1.Deployment) error {
+	deploymentsClient := r.clientset.AppsV1().Deployments(canary.Namespace)
+	stable, err := deploymentsClient.Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get stable deployment: %w", err)
+	}
+
+	template := canary.Spec.Template.DeepCopy()
+	delete(template.Labels, trackLabel)
+	template.Labels[deploymentLabel] = stable.Name
+	stable.Spec.Template = *template
+	if stable.Annotations == nil {
+		stable.Annotations = make(map[string]string)
+	}
+	stable.Annotations[revisionAnnotation] = canary.Annotations[revisionAnnotation]
+	setSpecHash(stable)
+
+	_, err = deploymentsClient.Update(ctx, stable, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not promote canary: %w", err)
+	}
+
+	logger.Infow("promoting canary", "namespacedName", name, "revision", canary.Annotations[revisionAnnotation])
+	canary.Annotations[canaryPromotedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	_, err = deploymentsClient.Update(ctx, canary, metav1.UpdateOptions{})
+	return err
+}
+
+// finishPromotion removes the canary once the stable deployment runs the promoted revision
+func (r *KubernetesReconciler) finishPromotion(ctx context.Context, name *protoStorage.NamespacedName, canary *appsv1.Deployment) (bool, error) {
+	stable, err := r.clientset.AppsV1().Deployments(canary.Namespace).Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("could not get stable deployment: %w", err)
+	}
+
+	if stable.Annotations[revisionAnnotation] != canary.Annotations[revisionAnnotation] || !isDeploymentReady(stable) {
+		return false, nil
+	}
+
+	logger.Infow("promoted canary", "namespacedName", name, "revision", canary.Annotations[revisionAnnotation])
+	r.statuses.set(name.Namespace, name.Name, StatusDeployed, "")
+	return true, r.deleteCanary(ctx, name)
+}
+
+func (r *KubernetesReconciler) abortCanary(ctx context.Context, name *protoStorage.NamespacedName, canary *appsv1.Deployment, reason string) error {
+	logger.Warnw("aborting canary", "namespacedName", name, "reason", reason)
+	r.statuses.set(name.Namespace, name.Name, StatusFailed, fmt.Sprintf("canary aborted: %s", reason))
+
+	deploymentsClient := r.clientset.AppsV1().Deployments(canary.Namespace)
+	stable, err := deploymentsClient.Get(ctx, serviceDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get stable deployment: %w", err)
+	}
+	if stable.Annotations == nil {
+		stable.Annotations = make(map[string]string)
+	}
+	stable.Annotations[canaryAbortedAnnotation] = canary.Annotations[revisionAnnotation]
+	_, err = deploymentsClient.Update(ctx, stable, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not mark canary as aborted: %w", err)
+	}
+
+	return r.deleteCanary(ctx, name)
+}
+
+// unhealthyReason returns why the pods cannot be considered healthy or an empty string if they are
+func unhealthyReason(pods []corev1.Pod, maxRestarts int32) string {
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.RestartCount > maxRestarts {
+				return fmt.Sprintf("pod %s restarted %d times", pod.Name, status.RestartCount)
+			}
+			if status.State.Waiting != nil {
+				switch status.State.Waiting.Reason {
+				case "CrashLoopBackOff", "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError":
+					return fmt.Sprintf("pod %s is in %s", pod.Name, status.State.Waiting.Reason)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// canaryWeight returns the percentage of traffic that should be sent to the canary of a service
+func (r *KubernetesReconciler) canaryWeight(ctx context.Context, name *protoStorage.NamespacedName) (int32, error) {
+	canary, err := r.clientset.AppsV1().Deployments(targetNamespace(name.Namespace)).Get(ctx, canaryDeploymentName(name), metav1.GetOptions{})
+	if err != nil {
+		if apiErrors.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	policy := config.GlobalPolicies().Rollout(name.Namespace, name.Name)
+	if policy.Strategy == config.RolloutStrategyRollingUpdate {
+		return 0, nil
+	}
+	step, _ := strconv.Atoi(canary.Annotations[canaryStepAnnotation])
+	return rolloutWeight(&policy, step), nil
+}
+
+// weightEndpoints merges both endpoint sets so that weight percent of the entries point to the canary.
+// The load balancer picks endpoints uniformly, so the traffic is split by repeating endpoints. The list is kept
+// to maxWeightedEndpoints entries, or one per endpoint if there are more, and the weight is approximated to fit.
+func weightEndpoints(stable []*protoCommon.Endpoint, canary []*protoCommon.Endpoint, weight int32) []*protoCommon.Endpoint {
+	if len(canary) == 0 || weight <= 0 {
+		return stable
+	}
+	if len(stable) == 0 || weight >= 100 {
+		return canary
+	}
+
+	stableRepeat := len(canary) * int(100-weight)
+	canaryRepeat := len(stable) * int(weight)
+	divisor := gcd(stableRepeat, canaryRepeat)
+	stableSlots := len(stable) * stableRepeat / divisor
+	canarySlots := len(canary) * canaryRepeat / divisor
+
+	if stableSlots+canarySlots > maxWeightedEndpoints {
+		slots := maxWeightedEndpoints
+		if slots < len(stable)+len(canary) {
+			slots = len(stable) + len(canary)
+		}
+		canarySlots = (slots*int(weight) + 50) / 100
+		if canarySlots < 1 {
+			canarySlots = 1
+		}
+		if canarySlots > slots-1 {
+			canarySlots = slots - 1
+		}
+		stableSlots = slots - canarySlots
+	}
+
+	endpoints := make([]*protoCommon.Endpoint, 0, stableSlots+canarySlots)
+	endpoints = appendSlots(endpoints, stable, stableSlots)
+	return appendSlots(endpoints, canary, canarySlots)
+}
+
+// appendSlots spreads the slots evenly over the endpoints, the first endpoints get one more if they cannot be
+// divided evenly. With fewer slots than endpoints only the first endpoints receive traffic.
+func appendSlots(list []*protoCommon.Endpoint, endpoints []*protoCommon.Endpoint, slots int) []*protoCommon.Endpoint {
+	for i, endpoint := range endpoints {
+		repeat := slots / len(endpoints)
+		if i < slots%len(endpoints) {
+			repeat++
+		}
+		for j := 0; j < repeat; j++ {
+			list = append(list, endpoint)
+		}
+	}
+	return list
+}
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,59 @@
+package reconciling
+
+import (
+	"fmt"
+	protoCommon "github.com/kulycloud/protocol/common"
+	"testing"
+)
+
+func testEndpoints(prefix string, count int) []*protoCommon.Endpoint {
+	endpoints := make([]*protoCommon.Endpoint, 0, count)
+	for i := 0; i < count; i++ {
+		endpoints = append(endpoints, &protoCommon.Endpoint{Host: fmt.Sprintf("%s-%d", prefix, i), Port: testHTTPPort})
+	}
+	return endpoints
+}
+
+func TestWeightEndpoints(t *testing.T) {
+	tests := []struct {
+		stable      int
+		canary      int
+		weight      int32
+		maxLength   int
+		canaryShare float64
+	}{
+		{stable: 1, canary: 1, weight: 10, maxLength: 10, canaryShare: 0.10},
+		{stable: 3, canary: 1, weight: 25, maxLength: 4, canaryShare: 0.25},
+		{stable: 7, canary: 3, weight: 13, maxLength: maxWeightedEndpoints, canaryShare: 0.13},
+		{stable: 50, canary: 50, weight: 10, maxLength: maxWeightedEndpoints, canaryShare: 0.10},
+		{stable: 50, canary: 50, weight: 1, maxLength: maxWeightedEndpoints, canaryShare: 0.01},
+		{stable: 150, canary: 20, weight: 20, maxLength: 170, canaryShare: 0.20},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d stable %d canary %d%%", test.stable, test.canary, test.weight), func(t *testing.T) {
+			stable := testEndpoints("stable", test.stable)
+			canary := testEndpoints("canary", test.canary)
+			canaries := make(map[*protoCommon.Endpoint]bool)
+			for _, endpoint := range canary {
+				canaries[endpoint] = true
+			}
+
+			endpoints := weightEndpoints(stable, canary, test.weight)
+			if len(endpoints) > test.maxLength {
+				t.Fatalf("expected at most %d endpoints, got %d", test.maxLength, len(endpoints))
+			}
+
+			canaryCount := 0
+			for _, endpoint := range endpoints {
+				if canaries[endpoint] {
+					canaryCount++
+				}
+			}
+			share := float64(canaryCount) / float64(len(endpoints))
+			if share < test.canaryShare-0.01 || share > test.canaryShare+0.01 {
+				t.Errorf("expected a canary share of %.2f, got %.3f", test.canaryShare, share)
+			}
+		})
+	}
+}
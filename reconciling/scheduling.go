@@ -2,21 +2,36 @@ package reconciling
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
 	commonCommunication "github.com/kulycloud/common/communication"
+	"github.com/kulycloud/service-manager-k8s/config"
 	"time"
 )
 
+var ErrStorageNotReady = errors.New("storage is not ready")
+
 const ResourceTypeService = "service"
-const ReconcilePeriod = 1 * time.Hour
-const ReconcileCheckLoop = 5 * time.Minute
-const ReconcileLoopErrorRetry = 1 * time.Minute
+const RolloutCheckLoop = 15 * time.Second
+const ConfigCheckLoop = 10 * time.Second
 const TriggerPeriod = "period"
 const TriggerEvent = "event"
+const TriggerRequest = "request"
+const TriggerConfig = "config"
+
+// namespaceSchedule tracks when a namespace is due for its next periodic reconcile
+type namespaceSchedule struct {
+	next     time.Time
+	failures int
+}
 
 type ReconcileScheduler struct {
 	Reconciler      Reconciler
 	storage         *commonCommunication.StorageCommunicator
-	namespaces      map[string]time.Time
+	namespaces      map[string]*namespaceSchedule
+	namespacesMutex sync.Mutex
 	stop            bool
 	storageNotifier chan interface{}
 }
@@ -26,7 +41,7 @@ func NewReconcilerScheduler(storage *commonCommunication.StorageCommunicator, re
 		Reconciler: reconciler,
 		storage:    storage,
 		stop:       false,
-		namespaces: make(map[string]time.Time),
+		namespaces: make(map[string]*namespaceSchedule),
 		storageNotifier: make(chan interface{}),
 	}, nil
 }
@@ -70,40 +85,200 @@ func (scheduler *ReconcileScheduler) onStorageChangedEvent(event *commonCommunic
 		}()
 	}
 
+	if !scheduler.storage.Ready() {
+		scheduler.Reconciler.Freeze("storage is not ready")
+	}
 	scheduler.Reconciler.PropagateStorageToLoadBalancers(context.Background(), event.Endpoints)
 }
 
-func (scheduler *ReconcileScheduler) ReconcileNamespace(ctx context.Context, namespace string, trigger string) {
+func (scheduler *ReconcileScheduler) ReconcileNamespace(ctx context.Context, namespace string, trigger string) error {
 	logger.Infow("reconciling namespace",
 		"trigger", trigger,
 		"namespace", namespace)
-	err := scheduler.Reconciler.ReconcileDeployments(ctx, namespace)
+	err := scheduler.Reconciler.ReconcileDeployments(WithTrigger(ctx, trigger), namespace)
+
+	scheduler.namespacesMutex.Lock()
+	schedule, ok := scheduler.namespaces[namespace]
+	if !ok {
+		schedule = &namespaceSchedule{}
+		scheduler.namespaces[namespace] = schedule
+	}
+	timing := config.GlobalConfig().Timing()
 	if err == nil {
-		scheduler.namespaces[namespace] = time.Now()
+		schedule.failures = 0
+		schedule.next = time.Now().Add(jitter(config.GlobalPolicies().ReconcilePeriod(namespace), timing.ReconcileJitter))
 	} else {
+		schedule.failures++
+		schedule.next = time.Now().Add(jitter(backoff(timing, schedule.failures), timing.ReconcileJitter))
+	}
+	scheduler.namespacesMutex.Unlock()
+
+	if err != nil {
 		logger.Errorw("error reconciling namespace",
-			"trigger", "period",
+			"trigger", trigger,
 			"namespace", namespace,
 			"error", err)
 	}
+	return err
+}
+
+// ReconcileService reconciles a single service immediately
+func (scheduler *ReconcileScheduler) ReconcileService(ctx context.Context, namespace string, name string) error {
+	if !scheduler.storage.Ready() {
+		return ErrStorageNotReady
+	}
+
+	logger.Infow("reconciling service",
+		"trigger", TriggerRequest,
+		"namespace", namespace,
+		"name", name)
+	return scheduler.Reconciler.ReconcileService(WithTrigger(ctx, TriggerRequest), namespace, name)
+}
+
+// ReconcileNamespaceNow reconciles a namespace immediately and pushes the resulting endpoints to its load balancers
+func (scheduler *ReconcileScheduler) ReconcileNamespaceNow(ctx context.Context, namespace string) error {
+	if !scheduler.storage.Ready() {
+		return ErrStorageNotReady
+	}
+
+	err := scheduler.ReconcileNamespace(ctx, namespace, TriggerRequest)
+	if err != nil {
+		return err
+	}
+	return scheduler.Reconciler.ResyncLoadBalancers(ctx, namespace)
+}
+
+// ReconcileAll reconciles every namespace immediately and resyncs all load balancers
+func (scheduler *ReconcileScheduler) ReconcileAll(ctx context.Context) error {
+	return scheduler.reconcileAll(ctx, TriggerRequest)
+}
+
+func (scheduler *ReconcileScheduler) reconcileAll(ctx context.Context, trigger string) error {
+	if !scheduler.storage.Ready() {
+		return ErrStorageNotReady
+	}
+
+	namespaces, err := scheduler.storage.GetNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, namespace := range namespaces {
+		if scheduler.ReconcileNamespace(ctx, namespace, trigger) != nil {
+			failed++
+		}
+	}
+
+	// a failed namespace may have been read incompletely, so nothing is cleaned up until every namespace succeeded
+	if failed > 0 {
+		return fmt.Errorf("could not reconcile %d of %d namespaces", failed, len(namespaces))
+	}
+
+	err = scheduler.Reconciler.ReconcileNamespaces(ctx, namespaces)
+	if err != nil {
+		return err
+	}
+	return scheduler.Resync(ctx)
+}
+
+// Resync pushes storage and endpoint lists to all load balancers again
+func (scheduler *ReconcileScheduler) Resync(ctx context.Context) error {
+	if !scheduler.storage.Ready() {
+		return ErrStorageNotReady
+	}
+
+	scheduler.Reconciler.PropagateStorageToLoadBalancers(ctx, scheduler.storage.Endpoints)
+	return scheduler.Reconciler.ResyncLoadBalancers(ctx, "")
 }
 
 func (scheduler *ReconcileScheduler) needsReconcile(namespace string) bool {
-	t, ok := scheduler.namespaces[namespace]
-	return !ok || time.Now().Sub(t) >= ReconcilePeriod
+	scheduler.namespacesMutex.Lock()
+	defer scheduler.namespacesMutex.Unlock()
+	schedule, ok := scheduler.namespaces[namespace]
+	return !ok || !time.Now().Before(schedule.next)
+}
+
+// nextCheck returns how long the reconcile loop can sleep until the next namespace is due.
+// It is capped by the check loop so new namespaces are picked up.
+func (scheduler *ReconcileScheduler) nextCheck() time.Duration {
+	scheduler.namespacesMutex.Lock()
+	defer scheduler.namespacesMutex.Unlock()
+
+	wait := config.GlobalConfig().Timing().ReconcileCheckLoop
+	for _, schedule := range scheduler.namespaces {
+		if until := time.Until(schedule.next); until < wait {
+			wait = until
+		}
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// backoff doubles the error retry with every consecutive failure up to the maximum backoff
+func backoff(timing config.Timing, failures int) time.Duration {
+	delay := timing.ReconcileErrorRetry
+	for i := 1; i < failures && delay < timing.ReconcileMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > timing.ReconcileMaxBackoff {
+		delay = timing.ReconcileMaxBackoff
+	}
+	return delay
 }
 
+// jitter spreads a duration by up to the given fraction in both directions so namespaces do not reconcile in lockstep
+func jitter(duration time.Duration, fraction float64) time.Duration {
+	return time.Duration(float64(duration) * (1 + fraction*(2*rand.Float64()-1)))
+}
+
+// checkNamespaces reconciles all namespaces that are due. While frozen every namespace is reconciled,
+// the load balancers are thawed once all of them could be read from storage.
 func (scheduler *ReconcileScheduler) checkNamespaces(ctx context.Context) error {
 	logger.Infow("reconciling namespaces",
 		"trigger", TriggerPeriod)
 	namespaces, err := scheduler.storage.GetNamespaces(ctx)
 	if err != nil {
+		scheduler.Reconciler.Freeze(err.Error())
 		return err
 	}
 
+	frozen := scheduler.Reconciler.Frozen()
+	unreadable := 0
 	for _, namespace := range namespaces {
-		if scheduler.needsReconcile(namespace) {
-			scheduler.ReconcileNamespace(ctx, namespace, TriggerPeriod)
+		if frozen || scheduler.needsReconcile(namespace) {
+			err = scheduler.ReconcileNamespace(ctx, namespace, TriggerPeriod)
+			if errors.Is(err, ErrStorageRead) {
+				unreadable++
+			}
+		}
+	}
+	if unreadable > 0 {
+		return fmt.Errorf("%w: %d of %d namespaces", ErrStorageRead, unreadable, len(namespaces))
+	}
+	if frozen {
+		err = scheduler.Reconciler.Thaw(ctx)
+		if err != nil {
+			logger.Warnw("could not resync load balancers after storage became available", "error", err)
+		}
+	}
+
+	err = scheduler.Reconciler.ReconcileNamespaces(ctx, namespaces)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, namespace := range namespaces {
+		known[namespace] = true
+	}
+	scheduler.namespacesMutex.Lock()
+	defer scheduler.namespacesMutex.Unlock()
+	for namespace := range scheduler.namespaces {
+		if !known[namespace] {
+			delete(scheduler.namespaces, namespace)
 		}
 	}
 	return nil
@@ -111,18 +286,61 @@ func (scheduler *ReconcileScheduler) checkNamespaces(ctx context.Context) error
 
 func (scheduler *ReconcileScheduler) reconcileLoop() {
 	ctx := context.Background()
+	failures := 0
 
 	for !scheduler.stop {
+		timing := config.GlobalConfig().Timing()
 		if !scheduler.storage.Ready() {
 			logger.Warnw("trying to reconcile but storage is not ready")
-			time.Sleep(ReconcileLoopErrorRetry)
+			scheduler.Reconciler.Freeze("storage is not ready")
+			failures++
+			time.Sleep(jitter(backoff(timing, failures), timing.ReconcileJitter))
 			continue
 		}
 		err := scheduler.checkNamespaces(ctx)
 		if err == nil {
-			time.Sleep(ReconcileCheckLoop)
+			failures = 0
+			time.Sleep(scheduler.nextCheck())
 		} else {
-			time.Sleep(ReconcileLoopErrorRetry)
+			logger.Warnw("error checking namespaces", "error", err)
+			failures++
+			time.Sleep(jitter(backoff(timing, failures), timing.ReconcileJitter))
+		}
+	}
+}
+
+func (scheduler *ReconcileScheduler) rolloutLoop() {
+	ctx := context.Background()
+
+	for !scheduler.stop {
+		err := scheduler.Reconciler.ReconcileRollouts(ctx)
+		if err != nil {
+			logger.Warnw("error reconciling rollouts", "error", err)
+		}
+		time.Sleep(RolloutCheckLoop)
+	}
+}
+
+// configLoop applies config file changes and renders all resources again if they are affected
+func (scheduler *ReconcileScheduler) configLoop() {
+	ctx := context.Background()
+	watcher := config.NewWatcher()
+
+	for !scheduler.stop {
+		time.Sleep(ConfigCheckLoop)
+
+		render, err := watcher.Check()
+		if err != nil {
+			logger.Warnw("could not reload config", "error", err)
+			continue
+		}
+		if !render {
+			continue
+		}
+
+		err = scheduler.reconcileAll(ctx, TriggerConfig)
+		if err != nil {
+			logger.Warnw("could not reconcile after config change", "error", err)
 		}
 	}
 }
@@ -136,7 +354,7 @@ func (scheduler *ReconcileScheduler) Start() <-chan error {
 		scheduler.storageNotifier = nil
 
 		for !scheduler.storage.Ready() {
-			time.Sleep(10 * time.Second)
+			time.Sleep(config.GlobalConfig().Timing().StorageWaitInterval)
 		}
 
 		go func() {
@@ -146,6 +364,8 @@ func (scheduler *ReconcileScheduler) Start() <-chan error {
 			}
 		}()
 
+		go scheduler.rolloutLoop()
+		go scheduler.configLoop()
 		scheduler.reconcileLoop()
 	}()
 
@@ -0,0 +1,70 @@
+package reconciling
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	StatusDeployed      = "Deployed"
+	StatusProgressing   = "Progressing"
+	StatusQuotaExceeded = "QuotaExceeded"
+	StatusFailed        = "Failed"
+)
+
+type ServiceStatus struct {
+	Phase   string
+	Message string
+	Updated time.Time
+}
+
+// statusStore keeps the outcome of the last reconcile of every service
+type statusStore struct {
+	mutex    sync.RWMutex
+	statuses map[string]*ServiceStatus
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{
+		statuses: make(map[string]*ServiceStatus),
+	}
+}
+
+func statusKey(namespace string, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+func (store *statusStore) set(namespace string, name string, phase string, message string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.statuses[statusKey(namespace, name)] = &ServiceStatus{
+		Phase:   phase,
+		Message: message,
+		Updated: time.Now(),
+	}
+}
+
+func (store *statusStore) get(namespace string, name string) (ServiceStatus, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	status, ok := store.statuses[statusKey(namespace, name)]
+	if !ok {
+		return ServiceStatus{}, false
+	}
+	return *status, true
+}
+
+func (store *statusStore) delete(namespace string, name string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.statuses, statusKey(namespace, name))
+}
+
+// ServiceStatus returns the outcome of the last reconcile of a service
+func (r *KubernetesReconciler) ServiceStatus(namespace string, name string) (ServiceStatus, bool) {
+	return r.statuses.get(namespace, name)
+}
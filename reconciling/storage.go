@@ -0,0 +1,29 @@
+package reconciling
+
+import (
+	"context"
+	commonCommunication "github.com/kulycloud/common/communication"
+	protoCommon "github.com/kulycloud/protocol/common"
+	protoStorage "github.com/kulycloud/protocol/storage"
+)
+
+// Storage is the part of the kuly storage the reconciler depends on
+type Storage interface {
+	GetServicesInNamespace(ctx context.Context, namespace string) ([]string, error)
+	GetService(ctx context.Context, namespace string, name string) (*protoStorage.Service, error)
+	SetService(ctx context.Context, namespace string, name string, service *protoStorage.Service) error
+	SetServiceLBEndpoints(ctx context.Context, namespace string, name string, endpoints []*protoCommon.Endpoint) error
+	// StorageEndpoints returns the endpoints of the storage itself that are handed to the load balancers
+	StorageEndpoints() []*protoCommon.Endpoint
+}
+
+var _ Storage = &communicatorStorage{}
+
+// communicatorStorage is the storage as it is reached through the control plane
+type communicatorStorage struct {
+	*commonCommunication.StorageCommunicator
+}
+
+func (storage *communicatorStorage) StorageEndpoints() []*protoCommon.Endpoint {
+	return storage.Endpoints
+}
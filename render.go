@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	commonConfig "github.com/kulycloud/common/config"
+	protoStorage "github.com/kulycloud/protocol/storage"
+	"github.com/kulycloud/service-manager-k8s/config"
+	"github.com/kulycloud/service-manager-k8s/reconciling"
+	"io/ioutil"
+	"os"
+)
+
+type renderParams struct {
+	File      string `configName:"file"`
+	Namespace string `configName:"namespace" defaultValue:"default"`
+	Name      string `configName:"name"`
+}
+
+// runRender prints the manifests the manager would create for a service definition.
+// Usage: service-manager-k8s render --file service.yaml --name web [--namespace default] [config params]
+func runRender() error {
+	params := &renderParams{}
+	parser := commonConfig.NewParser()
+	parser.AddProvider(commonConfig.NewCliParamProvider())
+	err := parser.Populate(params)
+	if err != nil {
+		return err
+	}
+
+	err = config.ParseOfflineConfig()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(params.File)
+	if err != nil {
+		return fmt.Errorf("could not read service definition: %w", err)
+	}
+	service, err := reconciling.ParseServiceDefinition(data)
+	if err != nil {
+		return err
+	}
+
+	manifests, err := reconciling.RenderYAML(&protoStorage.NamespacedName{Namespace: params.Namespace, Name: params.Name}, service)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(manifests)
+	return err
+}